@@ -1,10 +1,12 @@
 package api
 
 import (
+	"io"
 	"log"
 	"runtime/debug"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/VimeWorld/matches-db/storage"
@@ -12,30 +14,68 @@ import (
 	"github.com/valyala/fasthttp"
 )
 
+// Через сколько секунд клиенту стоит повторить запись, если база в режиме обслуживания
+const writeLockedRetryAfter = 60
+
+// Ограничение на тело запроса для всех маршрутов, кроме тех, что читают его потоком
+const maxRequestBodySize = fasthttp.DefaultMaxRequestBodySize
+
+// Маршруты, которые сами читают тело запроса потоком
+var streamingRoutes = map[string]bool{
+	"/matches/bulk": true,
+}
+
 type Server struct {
 	server *fasthttp.Server
 
+	jobsMu sync.Mutex
+	jobs   map[string]*job
+
 	Users   *storage.UserStorage
 	Matches *storage.MatchesStorage
 }
 
 func (s *Server) Bind(bind string) error {
 	r := router.New()
+	r.SaveMatchedRoutePath = true
 	r.GET("/user/getMatches", s.handleUserMatches)
 	r.GET("/user/getMatchesAfter", s.handleUserMatchesAfter)
 	r.GET("/user/getMatchesBefore", s.handleUserMatchesBefore)
+	r.GET("/user/getCommonMatches", s.handleCommonMatches)
+	r.GET("/user/getMatchCount", s.handleUserMatchCount)
+	r.GET("/user/getStats", s.handleUserStats)
+	r.POST("/users/getMatches", s.handleUsersMatches)
 
 	r.GET(`/match/{id}`, fasthttp.CompressHandler(s.handleGetMatch))
-	r.POST(`/match/{id}`, s.handlePostMatch)
+	r.POST(`/match/{id}`, s.writeHandler(s.handlePostMatch))
+	r.DELETE(`/match/{id}`, s.writeHandler(s.handleDeleteMatch))
+	r.POST("/matches/bulk", s.handleBulkMatches)
+	r.GET("/matches", fasthttp.CompressHandler(s.handleGetMatches))
+	r.POST("/matches/get", fasthttp.CompressHandler(s.handlePostGetMatches))
 
 	r.GET("/manage/flatten", s.handleFlatten)
+	r.GET("/manage/export", s.handleExport)
+	r.GET("/manage/backup", s.handleBackup)
+	r.GET("/manage/reindex", s.handleReindex)
+	r.GET("/manage/reindex/status", s.handleJobStatus("reindex"))
+	r.GET("/manage/verify", s.handleVerify)
+	r.GET("/manage/verify/status", s.handleJobStatus("verify"))
+	r.GET("/manage/dictionary", s.handleTrainDictionary)
+	r.GET("/manage/recompress", s.handleRecompress)
+	r.GET("/manage/recompress/status", s.handleJobStatus("recompress"))
+	r.GET("/manage/lock", s.handleLock)
+	r.GET("/manage/unlock", s.handleUnlock)
+	r.GET("/metrics", s.handleMetrics)
 
 	s.server = &fasthttp.Server{
 		//Handler:           s.loggingHandler(r.Handler),
-		Handler:           r.Handler,
-		Name:              "matches-db",
-		ReadTimeout:       60 * time.Second,
-		ReduceMemoryUsage: true,
+		Handler:            s.metricsHandler(s.bodyLimitHandler(r.Handler)),
+		Name:               "matches-db",
+		ReadTimeout:        60 * time.Second,
+		ReduceMemoryUsage:  true,
+		MaxRequestBodySize: maxRequestBodySize,
+		// Тела больше MaxRequestBodySize отдаются обработчику потоком, ограничение для них проверяет bodyLimitHandler
+		StreamRequestBody: true,
 	}
 	if strings.HasPrefix(bind, "/") {
 		return s.server.ListenAndServeUNIX(bind, 0777)
@@ -60,6 +100,43 @@ func (s *Server) loggingHandler(handler fasthttp.RequestHandler) fasthttp.Reques
 	}
 }
 
+// Читает тело запроса в память, но не больше maxRequestBodySize. Сервер принимает тела потоком
+// ради /matches/bulk, а без этого PostBody прочитал бы поток любого размера целиком.
+func (s *Server) bodyLimitHandler(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if ctx.Request.IsBodyStream() && !streamingRoutes[string(ctx.Path())] {
+			body, err := io.ReadAll(io.LimitReader(ctx.RequestBodyStream(), maxRequestBodySize+1))
+			if err != nil {
+				ctx.Error(err.Error(), 400)
+				return
+			}
+			if len(body) > maxRequestBodySize {
+				ctx.Error(fasthttp.ErrBodyTooLarge.Error(), fasthttp.StatusRequestEntityTooLarge)
+				return
+			}
+			ctx.Request.SetBody(body)
+		}
+		handler(ctx)
+	}
+}
+
+// Отклоняет запросы на запись, пока включен режим обслуживания
+func (s *Server) writeHandler(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		if !s.Matches.Writes.Begin() {
+			writeLockedError(ctx)
+			return
+		}
+		defer s.Matches.Writes.Done()
+		handler(ctx)
+	}
+}
+
+func writeLockedError(ctx *fasthttp.RequestCtx) {
+	ctx.Error(storage.ErrWriteLocked.Error(), 503)
+	ctx.Response.Header.Set(fasthttp.HeaderRetryAfter, strconv.Itoa(writeLockedRetryAfter))
+}
+
 func parseInt(stringSlice []byte, fallback int) int {
 	if len(stringSlice) == 0 {
 		return fallback
@@ -71,6 +148,21 @@ func parseInt(stringSlice []byte, fallback int) int {
 	return num
 }
 
+// Принимает время в формате RFC3339 или unix миллисекунды
+func parseTime(stringSlice []byte) (uint64, bool) {
+	if len(stringSlice) == 0 {
+		return 0, true
+	}
+	if num, err := strconv.ParseUint(string(stringSlice), 10, 64); err == nil {
+		return num, true
+	}
+	t, err := time.Parse(time.RFC3339, string(stringSlice))
+	if err != nil || t.UnixMilli() <= 0 {
+		return 0, false
+	}
+	return uint64(t.UnixMilli()), true
+}
+
 func parseUint64(stringSlice []byte, fallback uint64) uint64 {
 	if len(stringSlice) == 0 {
 		return fallback
@@ -0,0 +1,134 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+
+	"github.com/VimeWorld/matches-db/storage"
+	"github.com/VimeWorld/matches-db/types"
+	"github.com/klauspost/compress/gzip"
+	"github.com/valyala/fasthttp"
+)
+
+const (
+	bulkBatchSize = 1000
+	// Одна строка не больше тела обычного запроса, все тело читается потоком и не ограничено
+	bulkMaxLineSize = maxRequestBodySize
+)
+
+type bulkRecord struct {
+	Id    uint64          `json:"id"`
+	Match json.RawMessage `json:"match"`
+}
+
+type bulkResult struct {
+	Line   int    `json:"line"`
+	Id     uint64 `json:"id,omitempty"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+}
+
+// Принимает NDJSON с записями {"id": ..., "match": {...}}, по желанию сжатый gzip,
+// и отвечает NDJSON с результатом для каждой непустой строки.
+func (s *Server) handleBulkMatches(c *fasthttp.RequestCtx) {
+	// Режим обслуживания проверяется для каждой пачки, а не на весь запрос, чтобы длинный поток
+	// не задерживал включение блокировки. Пачки после включения получают ошибку.
+	if s.Matches.Writes.Locked() {
+		writeLockedError(c)
+		return
+	}
+	var reader io.Reader = c.RequestBodyStream()
+	if reader == nil {
+		reader = bytes.NewReader(c.PostBody())
+	}
+	if string(c.Request.Header.Peek(fasthttp.HeaderContentEncoding)) == "gzip" {
+		gz, err := gzip.NewReader(reader)
+		if err != nil {
+			c.Error(err.Error(), 400)
+			return
+		}
+		defer func() { _ = gz.Close() }()
+		reader = gz
+	}
+
+	var results []*bulkResult
+	var batch []*storage.BulkMatch
+	var batchResults []*bulkResult
+	flush := func() {
+		if len(batch) == 0 {
+			return
+		}
+		var created []bool
+		err := s.Matches.Writes.Run(func() error {
+			var err error
+			created, err = s.Matches.SaveBulk(batch)
+			return err
+		})
+		for i, result := range batchResults {
+			if err != nil {
+				result.Status = "error"
+				result.Error = err.Error()
+			} else if created[i] {
+				result.Status = "created"
+			} else {
+				result.Status = "updated"
+			}
+		}
+		batch = batch[:0]
+		batchResults = batchResults[:0]
+	}
+
+	scanner := bufio.NewScanner(reader)
+	scanner.Buffer(make([]byte, 64<<10), bulkMaxLineSize)
+	line := 0
+	for scanner.Scan() {
+		line++
+		data := bytes.TrimSpace(scanner.Bytes())
+		if len(data) == 0 {
+			continue
+		}
+		result := &bulkResult{Line: line}
+		results = append(results, result)
+
+		var record bulkRecord
+		if err := json.Unmarshal(data, &record); err != nil {
+			result.Status = "error"
+			result.Error = err.Error()
+			continue
+		}
+		result.Id = record.Id
+		var match types.Match
+		if err := json.Unmarshal(record.Match, &match); err != nil {
+			result.Status = "error"
+			result.Error = err.Error()
+			continue
+		}
+		if record.Id == 0 {
+			result.Status = "error"
+			result.Error = "invalid id"
+			continue
+		}
+
+		batch = append(batch, &storage.BulkMatch{
+			Id:    record.Id,
+			Data:  record.Match,
+			Match: &match,
+		})
+		batchResults = append(batchResults, result)
+		if len(batch) >= bulkBatchSize {
+			flush()
+		}
+	}
+	flush()
+	if err := scanner.Err(); err != nil {
+		results = append(results, &bulkResult{Line: line + 1, Status: "error", Error: err.Error()})
+	}
+
+	c.Response.Header.Set(fasthttp.HeaderContentType, "application/x-ndjson")
+	encoder := json.NewEncoder(c)
+	for _, result := range results {
+		_ = encoder.Encode(result)
+	}
+}
@@ -0,0 +1,102 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Фоновая задача обслуживания, например переиндексация.
+// Одновременно может выполняться только одна задача каждого типа.
+type job struct {
+	mu sync.Mutex
+
+	Name       string     `json:"name"`
+	Running    bool       `json:"running"`
+	StartedAt  time.Time  `json:"started_at"`
+	FinishedAt *time.Time `json:"finished_at,omitempty"`
+	Processed  int64      `json:"processed"`
+	Total      int64      `json:"total"`
+	Error      string     `json:"error,omitempty"`
+	Result     any        `json:"result,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+func (j *job) progress(processed, total int64) {
+	j.mu.Lock()
+	j.Processed = processed
+	j.Total = total
+	j.mu.Unlock()
+}
+
+func (s *Server) getJob(name string) *job {
+	s.jobsMu.Lock()
+	defer s.jobsMu.Unlock()
+	if s.jobs == nil {
+		s.jobs = make(map[string]*job)
+	}
+	j, ok := s.jobs[name]
+	if !ok {
+		j = &job{Name: name}
+		s.jobs[name] = j
+	}
+	return j
+}
+
+// Запускает fn в фоне. Возвращает false, если задача с таким именем уже выполняется.
+func (s *Server) startJob(name string, fn func(ctx context.Context, j *job) (any, error)) bool {
+	j := s.getJob(name)
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if j.Running {
+		return false
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	j.Running = true
+	j.StartedAt = time.Now()
+	j.FinishedAt = nil
+	j.Processed = 0
+	j.Total = 0
+	j.Error = ""
+	j.Result = nil
+	j.cancel = cancel
+
+	go func() {
+		log.Printf("Job %s started", name)
+		result, err := fn(ctx, j)
+		cancel()
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		now := time.Now()
+		j.Running = false
+		j.FinishedAt = &now
+		j.Result = result
+		if err != nil {
+			j.Error = err.Error()
+			log.Printf("Job %s failed: %s", name, err)
+		} else {
+			log.Printf("Job %s finished in %s", name, now.Sub(j.StartedAt).Round(time.Second))
+		}
+	}()
+	return true
+}
+
+// Обработчик статуса задачи. С параметром cancel=true останавливает выполняющуюся задачу.
+func (s *Server) handleJobStatus(name string) fasthttp.RequestHandler {
+	return func(c *fasthttp.RequestCtx) {
+		j := s.getJob(name)
+		j.mu.Lock()
+		defer j.mu.Unlock()
+		if c.QueryArgs().GetBool("cancel") && j.Running {
+			j.cancel()
+		}
+		bytes, _ := json.Marshal(j)
+		c.Response.Header.Set(fasthttp.HeaderContentType, "application/json")
+		_, _ = c.Write(bytes)
+	}
+}
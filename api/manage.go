@@ -1,8 +1,14 @@
 package api
 
 import (
+	"bufio"
+	"context"
 	"fmt"
+	"log"
+	"math"
+	"strconv"
 
+	"github.com/VimeWorld/matches-db/storage"
 	"github.com/valyala/fasthttp"
 )
 
@@ -14,3 +20,166 @@ func (s *Server) handleFlatten(c *fasthttp.RequestCtx) {
 	}
 	c.Error("OK", 200)
 }
+
+// Включает режим обслуживания: запись матчей отклоняется с кодом 503, чтение продолжает работать.
+// Ответ приходит после того, как завершатся уже начатые записи, включая пачки задач обслуживания.
+func (s *Server) handleLock(c *fasthttp.RequestCtx) {
+	s.Matches.Writes.Lock()
+	log.Printf("Writes are locked")
+	c.Error("OK", 200)
+}
+
+func (s *Server) handleUnlock(c *fasthttp.RequestCtx) {
+	s.Matches.Writes.Unlock()
+	log.Printf("Writes are unlocked")
+	c.Error("OK", 200)
+}
+
+// Выгружает матчи в NDJSON в формате {"id": ..., "match": {...}}, который принимает /matches/bulk.
+//
+// После каждого выгруженного окна пишется строка {"cursor": "..."}. Если соединение оборвалось,
+// выгрузку можно продолжить, передав последний полученный курсор в параметре cursor.
+func (s *Server) handleExport(c *fasthttp.RequestCtx) {
+	from := parseUint64(c.QueryArgs().Peek("from"), 0)
+	to := parseUint64(c.QueryArgs().Peek("to"), math.MaxUint64)
+	if cursor := c.QueryArgs().Peek("cursor"); len(cursor) > 0 {
+		from = parseUint64(cursor, 0)
+		if from == 0 {
+			c.Error("invalid cursor", 400)
+			return
+		}
+	}
+	if from > to {
+		c.Error("invalid range", 400)
+		return
+	}
+
+	c.Response.Header.Set(fasthttp.HeaderContentType, "application/x-ndjson")
+	c.SetBodyStreamWriter(func(w *bufio.Writer) {
+		var buf []byte
+		err := s.Matches.Export(context.Background(), from, to, func(id uint64, data []byte) error {
+			buf = append(buf[:0], `{"id":`...)
+			buf = strconv.AppendUint(buf, id, 10)
+			buf = append(buf, `,"match":`...)
+			buf = append(buf, data...)
+			buf = append(buf, "}\n"...)
+			_, err := w.Write(buf)
+			return err
+		}, func(next uint64) error {
+			buf = append(buf[:0], `{"cursor":"`...)
+			buf = strconv.AppendUint(buf, next, 10)
+			buf = append(buf, "\"}\n"...)
+			if _, err := w.Write(buf); err != nil {
+				return err
+			}
+			return w.Flush()
+		})
+		if err != nil {
+			log.Printf("Export error: %s", err)
+		}
+	})
+}
+
+// Отдает бэкап badger. С параметром since отдает только записи с версией больше since.
+//
+// Заголовок X-Backup-Version содержит версию базы на момент начала бэкапа, ее нужно передать в since
+// следующего инкрементального бэкапа. Записи, сделанные во время бэкапа, могут попасть в оба бэкапа,
+// на восстановление это не влияет.
+func (s *Server) handleBackup(c *fasthttp.RequestCtx) {
+	since := parseUint64(c.QueryArgs().Peek("since"), 0)
+	version := s.Matches.DB.MaxVersion()
+
+	c.Response.Header.Set(fasthttp.HeaderContentType, "application/octet-stream")
+	c.Response.Header.Set("X-Backup-Version", strconv.FormatUint(version, 10))
+	c.SetBodyStreamWriter(func(w *bufio.Writer) {
+		if _, err := s.Matches.DB.Backup(w, since); err != nil {
+			log.Printf("Backup error: %s", err)
+		}
+	})
+}
+
+// Запускает переиндексацию матчей в фоне. Параметр rate ограничивает количество матчей в секунду.
+// Прогресс можно посмотреть в /manage/reindex/status.
+func (s *Server) handleReindex(c *fasthttp.RequestCtx) {
+	rate := parseInt(c.QueryArgs().Peek("rate"), 0)
+	if rate < 0 {
+		c.Error("invalid rate", 400)
+		return
+	}
+	if s.Matches.Writes.Locked() {
+		writeLockedError(c)
+		return
+	}
+	started := s.startJob("reindex", func(ctx context.Context, j *job) (any, error) {
+		return nil, s.Matches.Reindex(ctx, storage.ReindexOptions{
+			Rate:     rate,
+			Progress: j.progress,
+		})
+	})
+	if !started {
+		c.Error("reindex is already running", 409)
+		return
+	}
+	c.Error("Started", 202)
+}
+
+// Запускает проверку индексов пользователей в фоне. С параметром fix=true найденные ошибки исправляются.
+// Отчет появится в /manage/verify/status после завершения.
+func (s *Server) handleVerify(c *fasthttp.RequestCtx) {
+	fix := c.QueryArgs().GetBool("fix")
+	if fix && s.Matches.Writes.Locked() {
+		writeLockedError(c)
+		return
+	}
+	started := s.startJob("verify", func(ctx context.Context, j *job) (any, error) {
+		return s.Users.Verify(ctx, fix, func(processed int64) {
+			j.progress(processed, 0)
+		})
+	})
+	if !started {
+		c.Error("verify is already running", 409)
+		return
+	}
+	c.Error("Started", 202)
+}
+
+// Обучает новый словарь zstd на случайных матчах, параметр samples задает их количество.
+// Новые матчи сразу начинают сжиматься этим словарем.
+func (s *Server) handleTrainDictionary(c *fasthttp.RequestCtx) {
+	samples := parseInt(c.QueryArgs().Peek("samples"), 1000)
+	if samples <= 0 || samples > 100000 {
+		c.Error("invalid samples", 400)
+		return
+	}
+	if s.Matches.Writes.Locked() {
+		writeLockedError(c)
+		return
+	}
+	id, err := s.Matches.TrainDictionary(samples)
+	if err != nil {
+		c.Error(err.Error(), 500)
+		return
+	}
+	log.Printf("Trained zstd dictionary %d", id)
+	c.Response.Header.Set(fasthttp.HeaderContentType, "application/json")
+	_, _ = c.WriteString(`{"id":` + strconv.FormatUint(uint64(id), 10) + `}`)
+}
+
+// Запускает в фоне перезапись матчей в текущем формате, см. MatchesStorage.Recompress. Так матчам,
+// сохраненным без хэша, дописывается ETag, сырой deflate переводится в текущий формат,
+// а при загруженном словаре небольшие несжатые матчи сжимаются zstd.
+// Прогресс и количество перезаписанных матчей можно посмотреть в /manage/recompress/status.
+func (s *Server) handleRecompress(c *fasthttp.RequestCtx) {
+	if s.Matches.Writes.Locked() {
+		writeLockedError(c)
+		return
+	}
+	started := s.startJob("recompress", func(ctx context.Context, j *job) (any, error) {
+		return s.Matches.Recompress(ctx, j.progress)
+	})
+	if !started {
+		c.Error("recompress is already running", 409)
+		return
+	}
+	c.Error("Started", 202)
+}
@@ -3,6 +3,8 @@ package api
 import (
 	"encoding/json"
 	"strconv"
+	"strings"
+	"time"
 
 	"github.com/VimeWorld/matches-db/storage"
 	"github.com/VimeWorld/matches-db/types"
@@ -16,18 +18,56 @@ func (s *Server) handleGetMatch(c *fasthttp.RequestCtx) {
 		return
 	}
 
-	data, err := s.Matches.Get(uint64(id))
+	// Тела, сохраненные в zlib, отдаются как есть, CompressHandler не сжимает их повторно
+	acceptDeflate := c.Request.Header.HasAcceptEncoding("deflate")
+	ifNoneMatch := c.Request.Header.Peek(fasthttp.HeaderIfNoneMatch)
+	notModified := false
+	// Если ETag совпал, то тело не читается и не распаковывается
+	match, err := s.Matches.GetRaw(uint64(id), acceptDeflate, func(hash uint64) bool {
+		notModified = len(ifNoneMatch) > 0 && etagMatches(ifNoneMatch, matchETag(hash))
+		return notModified
+	})
 	if err != nil {
 		c.Error(err.Error(), 500)
 		return
 	}
-	if data == nil {
+	if match == nil {
 		c.Error("match not found", 404)
 		return
 	}
 
+	// Матч может быть перезаписан, поэтому кэш должен каждый раз проверять ETag.
+	c.Response.Header.Set(fasthttp.HeaderETag, matchETag(match.Hash))
+	c.Response.Header.Set(fasthttp.HeaderCacheControl, "public, no-cache")
+	c.Response.Header.SetLastModified(time.UnixMilli(int64(types.GetSnowflakeTs(uint64(id)))))
+	if notModified {
+		c.SetStatusCode(fasthttp.StatusNotModified)
+		return
+	}
+
 	c.Response.Header.Set(fasthttp.HeaderContentType, "application/json")
-	c.SetBody(data)
+	if match.Encoding != storage.EncodingIdentity {
+		c.Response.Header.Set(fasthttp.HeaderContentEncoding, match.Encoding)
+		c.Response.Header.Add(fasthttp.HeaderVary, fasthttp.HeaderAcceptEncoding)
+	}
+	c.SetBody(match.Data)
+}
+
+// ETag слабый, потому что одно и то же тело отдается в разных кодировках
+func matchETag(hash uint64) string {
+	return `W/"` + strconv.FormatUint(hash, 16) + `"`
+}
+
+// Проверяет, есть ли etag в заголовке If-None-Match. Сравнение слабое, как требует RFC 9110.
+func etagMatches(header []byte, etag string) bool {
+	etag = strings.TrimPrefix(etag, "W/")
+	for _, tag := range strings.Split(string(header), ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || strings.TrimPrefix(tag, "W/") == etag {
+			return true
+		}
+	}
+	return false
 }
 
 func (s *Server) handlePostMatch(c *fasthttp.RequestCtx) {
@@ -55,65 +95,43 @@ func (s *Server) handlePostMatch(c *fasthttp.RequestCtx) {
 		return
 	}
 
+	var created bool
 	err = s.Matches.Transaction(func(txn *storage.MatchesTransaction) error {
-		return txn.Put(id, body, true)
+		created, err = txn.Save(id, body, &match)
+		return err
 	})
 	if err != nil {
 		c.Error(err.Error(), 500)
 		return
 	}
 
-	var winners []uint32
-	if match.Winner.Player != 0 {
-		winners = []uint32{match.Winner.Player}
-	} else if len(match.Winner.Players) > 0 {
-		winners = match.Winner.Players
-	} else if match.Winner.Team != "" {
-		for _, team := range match.Teams {
-			if team.Id == match.Winner.Team {
-				winners = team.Members
-				break
-			}
-		}
-	} else if len(match.Winner.Teams) > 0 {
-		for _, team := range match.Teams {
-			for _, wTeamId := range match.Winner.Teams {
-				if team.Id == wTeamId {
-					winners = append(winners, team.Members...)
-				}
-			}
-		}
+	if created {
+		c.Error("Created", 201)
+	} else {
+		c.Error("OK", 200)
 	}
+}
 
-	users := make([]uint32, len(match.Players))
-	for i, player := range match.Players {
-		users[i] = player.Id
+func (s *Server) handleDeleteMatch(c *fasthttp.RequestCtx) {
+	intId, err := strconv.ParseInt(c.UserValue("id").(string), 10, 64)
+	if err != nil {
+		c.Error(err.Error(), 400)
+		return
 	}
 
-	err = s.Users.Transaction(func(txn *storage.UsersTransaction) error {
-		for _, user := range users {
-			var state byte = 0
-			if len(winners) == 0 {
-				state = 2
-			} else {
-				for _, a := range winners {
-					if user == a {
-						state = 1
-						break
-					}
-				}
-			}
-			err := txn.AddMatch(user, id, state)
-			if err != nil {
-				return err
-			}
-		}
-		return nil
-	}, true)
+	var found bool
+	err = s.Matches.Transaction(func(txn *storage.MatchesTransaction) error {
+		found, err = txn.Delete(uint64(intId))
+		return err
+	})
 	if err != nil {
 		c.Error(err.Error(), 500)
 		return
 	}
+	if !found {
+		c.Error("match not found", 404)
+		return
+	}
 
 	c.Error("OK", 200)
 }
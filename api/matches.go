@@ -0,0 +1,86 @@
+package api
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+	"strings"
+
+	"github.com/valyala/fasthttp"
+)
+
+// Максимальное количество матчей в одном запросе
+const maxBatchMatches = 1000
+
+type getMatchesRequest struct {
+	Ids []uint64 `json:"ids"`
+}
+
+func (s *Server) handlePostGetMatches(c *fasthttp.RequestCtx) {
+	var req getMatchesRequest
+	if err := json.Unmarshal(c.PostBody(), &req); err != nil {
+		c.Error(err.Error(), 400)
+		return
+	}
+	s.writeMatchBodies(c, req.Ids)
+}
+
+func (s *Server) handleGetMatches(c *fasthttp.RequestCtx) {
+	param := string(c.QueryArgs().Peek("ids"))
+	if param == "" {
+		c.Error("invalid ids", 400)
+		return
+	}
+	var ids []uint64
+	for _, part := range strings.Split(param, ",") {
+		id, err := strconv.ParseUint(part, 10, 64)
+		if err != nil {
+			c.Error("invalid ids", 400)
+			return
+		}
+		ids = append(ids, id)
+	}
+	s.writeMatchBodies(c, ids)
+}
+
+// Отвечает объектом id -> тело матча, для отсутствующих матчей null
+func (s *Server) writeMatchBodies(c *fasthttp.RequestCtx, ids []uint64) {
+	if len(ids) == 0 || len(ids) > maxBatchMatches {
+		c.Error("ids count must be between 1 and "+strconv.Itoa(maxBatchMatches), 400)
+		return
+	}
+	unique := ids[:0:0]
+	seen := make(map[uint64]bool, len(ids))
+	for _, id := range ids {
+		if !seen[id] {
+			seen[id] = true
+			unique = append(unique, id)
+		}
+	}
+
+	data, err := s.Matches.GetMany(unique)
+	if err != nil {
+		c.Error(err.Error(), 500)
+		return
+	}
+
+	var buf bytes.Buffer
+	buf.WriteByte('{')
+	for i, id := range unique {
+		if i > 0 {
+			buf.WriteByte(',')
+		}
+		buf.WriteByte('"')
+		buf.WriteString(strconv.FormatUint(id, 10))
+		buf.WriteString(`":`)
+		if data[i] == nil {
+			buf.WriteString("null")
+		} else {
+			buf.Write(data[i])
+		}
+	}
+	buf.WriteByte('}')
+
+	c.Response.Header.Set(fasthttp.HeaderContentType, "application/json")
+	c.SetBody(buf.Bytes())
+}
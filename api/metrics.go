@@ -0,0 +1,62 @@
+package api
+
+import (
+	"strconv"
+	"time"
+
+	"github.com/fasthttp/router"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/valyala/fasthttp"
+	"github.com/valyala/fasthttp/fasthttpadaptor"
+)
+
+var (
+	httpRequests = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "matchesdb_http_requests_total",
+		Help: "HTTP requests by route, method and status code.",
+	}, []string{"route", "method", "code"})
+	httpDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchesdb_http_request_duration_seconds",
+		Help:    "HTTP request latency by route.",
+		Buckets: []float64{.0005, .001, .0025, .005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10},
+	}, []string{"route"})
+
+	prometheusHandler = fasthttpadaptor.NewFastHTTPHandler(promhttp.Handler())
+)
+
+// Считает запросы и их длительность по маршрутам. Для ответов потоком, например /manage/export,
+// учитывается только время до начала отправки.
+func (s *Server) metricsHandler(handler fasthttp.RequestHandler) fasthttp.RequestHandler {
+	return func(ctx *fasthttp.RequestCtx) {
+		start := time.Now()
+		handler(ctx)
+		route, _ := ctx.UserValue(router.MatchedRoutePathParam).(string)
+		if route == "" {
+			route = "unmatched"
+		}
+		httpRequests.WithLabelValues(route, methodLabel(ctx), strconv.Itoa(ctx.Response.StatusCode())).Inc()
+		httpDuration.WithLabelValues(route).Observe(time.Since(start).Seconds())
+	}
+}
+
+// Метод запроса для метки. Остальные методы клиент может прислать какие угодно, поэтому
+// они сводятся в other, чтобы не плодить серии.
+func methodLabel(ctx *fasthttp.RequestCtx) string {
+	switch {
+	case ctx.IsGet():
+		return fasthttp.MethodGet
+	case ctx.IsPost():
+		return fasthttp.MethodPost
+	case ctx.IsDelete():
+		return fasthttp.MethodDelete
+	case ctx.IsHead():
+		return fasthttp.MethodHead
+	}
+	return "other"
+}
+
+func (s *Server) handleMetrics(c *fasthttp.RequestCtx) {
+	prometheusHandler(c)
+}
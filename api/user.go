@@ -2,7 +2,10 @@ package api
 
 import (
 	"encoding/json"
+	"strconv"
+	"strings"
 
+	"github.com/VimeWorld/matches-db/storage"
 	"github.com/VimeWorld/matches-db/types"
 	"github.com/valyala/fasthttp"
 )
@@ -23,14 +26,26 @@ func (s *Server) handleUserMatches(c *fasthttp.RequestCtx) {
 		c.Error("invalid user id", 400)
 		return
 	}
+	r, ok := parseMatchFilter(c)
+	if !ok {
+		return
+	}
 
-	matches, err := s.Users.GetLastUserMatches(uint32(user), offset, count)
-	if err != nil {
-		c.Error(err.Error(), 500)
+	cursor, ok := parseCursor(c)
+	if !ok {
+		return
+	}
+	if cursor != nil {
+		s.writeUserMatches(c, func(txn *storage.UsersTransaction) ([]*types.UserMatch, error) {
+			return txn.GetUserMatchesFromCursor(uint32(user), *cursor, count, r)
+		}, *cursor)
 		return
 	}
 
-	jsonMatches(c, matches, true)
+	// Если матчей нет, то и старше них ничего нет, поэтому курсор указывает на начало истории
+	s.writeUserMatches(c, func(txn *storage.UsersTransaction) ([]*types.UserMatch, error) {
+		return txn.GetLastUserMatches(uint32(user), offset, count, r)
+	}, storage.NewCursor(0, false))
 }
 
 func (s *Server) handleUserMatchesAfter(c *fasthttp.RequestCtx) {
@@ -45,14 +60,20 @@ func (s *Server) handleUserMatchesAfter(c *fasthttp.RequestCtx) {
 		c.Error("invalid user id", 400)
 		return
 	}
-
-	matches, err := s.Users.GetUserMatchesAfter(uint32(user), after, count)
-	if err != nil {
-		c.Error(err.Error(), 500)
+	r, ok := parseMatchFilter(c)
+	if !ok {
+		return
+	}
+	from := storage.NewCursor(after, true)
+	if cursor, ok := parseCursor(c); !ok {
 		return
+	} else if cursor != nil {
+		from = *cursor
 	}
 
-	jsonMatches(c, matches, true)
+	s.writeUserMatches(c, func(txn *storage.UsersTransaction) ([]*types.UserMatch, error) {
+		return txn.GetUserMatchesFromCursor(uint32(user), from, count, r)
+	}, from)
 }
 
 func (s *Server) handleUserMatchesBefore(c *fasthttp.RequestCtx) {
@@ -63,22 +84,265 @@ func (s *Server) handleUserMatchesBefore(c *fasthttp.RequestCtx) {
 		c.Error("invalid count", 400)
 		return
 	}
-	if before == 0 {
+	if user <= 0 {
+		c.Error("invalid user id", 400)
+		return
+	}
+	r, ok := parseMatchFilter(c)
+	if !ok {
+		return
+	}
+	cursor, ok := parseCursor(c)
+	if !ok {
+		return
+	}
+	from := storage.NewCursor(before, false)
+	if cursor != nil {
+		from = *cursor
+	} else if before == 0 {
 		c.Error("invalid before", 400)
 		return
 	}
+
+	s.writeUserMatches(c, func(txn *storage.UsersTransaction) ([]*types.UserMatch, error) {
+		return txn.GetUserMatchesFromCursor(uint32(user), from, count, r)
+	}, from)
+}
+
+func (s *Server) handleCommonMatches(c *fasthttp.RequestCtx) {
+	user := parseInt(c.QueryArgs().Peek("user"), 0)
+	other := parseInt(c.QueryArgs().Peek("other"), 0)
+	count := parseInt(c.QueryArgs().Peek("count"), 20)
+	after := parseUint64(c.QueryArgs().Peek("after"), 0)
+	before := parseUint64(c.QueryArgs().Peek("before"), 0)
+	if count < 0 {
+		c.Error("invalid count", 400)
+		return
+	}
 	if user <= 0 {
 		c.Error("invalid user id", 400)
 		return
 	}
+	if other <= 0 || other == user {
+		c.Error("invalid other user id", 400)
+		return
+	}
+	r, ok := parseMatchFilter(c)
+	if !ok {
+		return
+	}
 
-	matches, err := s.Users.GetUserMatchesBefore(uint32(user), before, count)
+	matches, err := s.Users.GetCommonMatches(uint32(user), uint32(other), after, before, count, r)
 	if err != nil {
 		c.Error(err.Error(), 500)
 		return
 	}
 
-	jsonMatches(c, matches, true)
+	c.Response.Header.Set("Content-Type", "application/json")
+	if len(matches) == 0 {
+		_, _ = c.WriteString("[]")
+		return
+	}
+	for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+		matches[i], matches[j] = matches[j], matches[i]
+	}
+	bytes, _ := json.Marshal(matches)
+	_, _ = c.Write(bytes)
+}
+
+func (s *Server) handleUserMatchCount(c *fasthttp.RequestCtx) {
+	user := parseInt(c.QueryArgs().Peek("user"), 0)
+	if user <= 0 {
+		c.Error("invalid user id", 400)
+		return
+	}
+
+	count, err := s.Users.GetMatchCount(uint32(user))
+	if err != nil {
+		c.Error(err.Error(), 500)
+		return
+	}
+
+	c.Response.Header.Set("Content-Type", "application/json")
+	_, _ = c.WriteString(`{"count":` + strconv.Itoa(count) + `}`)
+}
+
+func (s *Server) handleUserStats(c *fasthttp.RequestCtx) {
+	user := parseInt(c.QueryArgs().Peek("user"), 0)
+	if user <= 0 {
+		c.Error("invalid user id", 400)
+		return
+	}
+
+	stats, err := s.Users.GetStats(uint32(user))
+	if err != nil {
+		c.Error(err.Error(), 500)
+		return
+	}
+
+	c.Response.Header.Set("Content-Type", "application/json")
+	bytes, _ := json.Marshal(stats)
+	_, _ = c.Write(bytes)
+}
+
+// Ограничение на суммарный размер тел матчей в ответе с expand=true
+const maxExpandSize = 8 << 20
+
+type expandedMatch struct {
+	Id    uint64          `json:"id"`
+	State byte            `json:"state"`
+	Match json.RawMessage `json:"match"`
+}
+
+// Выполняет запрос списка матчей и отвечает им, начиная с новых. from - позиция, с которой начинается
+// страница, и направление листания. С параметром expand=true в ответ добавляются тела матчей,
+// прочитанные в той же транзакции. Если тела не помещаются в maxExpandSize, то список обрезается
+// со стороны, дальней от from, и выставляется заголовок X-Truncated.
+//
+// В заголовке X-Next-Cursor всегда отдается курсор для параметра cursor следующей страницы:
+// после последнего отданного матча, а если матчей нет, то с той же позиции. Пустая страница
+// при листании к старым матчам означает, что история закончилась.
+func (s *Server) writeUserMatches(c *fasthttp.RequestCtx, query func(txn *storage.UsersTransaction) ([]*types.UserMatch, error), from storage.Cursor) {
+	newest := !from.Forward
+	setNextCursor := func(next storage.Cursor) {
+		c.Response.Header.Set("X-Next-Cursor", next.String())
+	}
+
+	if string(c.QueryArgs().Peek("expand")) != "true" {
+		var matches []*types.UserMatch
+		err := s.Users.Transaction(func(txn *storage.UsersTransaction) error {
+			var err error
+			matches, err = query(txn)
+			return err
+		}, false)
+		if err != nil {
+			c.Error(err.Error(), 500)
+			return
+		}
+		setNextCursor(nextCursor(matches, from))
+		jsonMatches(c, matches, true)
+		return
+	}
+
+	var expanded []*expandedMatch
+	truncated := false
+	err := s.Matches.View(func(txn *storage.MatchesTransaction) error {
+		matches, err := query(txn.Users())
+		if err != nil {
+			return err
+		}
+		expanded = make([]*expandedMatch, 0, len(matches))
+		size := 0
+		for i := range matches {
+			m := matches[i]
+			if newest {
+				m = matches[len(matches)-1-i]
+			}
+			data, err := txn.Get(m.Id)
+			if err != nil {
+				return err
+			}
+			if len(expanded) > 0 && size+len(data) > maxExpandSize {
+				truncated = true
+				break
+			}
+			size += len(data)
+			e := &expandedMatch{Id: m.Id, State: m.State, Match: data}
+			if data == nil {
+				e.Match = json.RawMessage("null")
+			}
+			expanded = append(expanded, e)
+		}
+		return nil
+	})
+	if err != nil {
+		c.Error(err.Error(), 500)
+		return
+	}
+	next := from
+	if len(expanded) > 0 {
+		next = storage.NewCursor(expanded[len(expanded)-1].Id, from.Forward)
+	}
+	setNextCursor(next)
+	if !newest {
+		for i, j := 0, len(expanded)-1; i < j; i, j = i+1, j-1 {
+			expanded[i], expanded[j] = expanded[j], expanded[i]
+		}
+	}
+
+	if truncated {
+		c.Response.Header.Set("X-Truncated", "true")
+	}
+	c.Response.Header.Set("Content-Type", "application/json")
+	if len(expanded) == 0 {
+		_, _ = c.WriteString("[]")
+		return
+	}
+	bytes, _ := json.Marshal(expanded)
+	_, _ = c.Write(bytes)
+}
+
+// Возвращает курсор следующей страницы после matches, отсортированных по id
+func nextCursor(matches []*types.UserMatch, from storage.Cursor) storage.Cursor {
+	if len(matches) == 0 {
+		return from
+	}
+	if from.Forward {
+		return storage.NewCursor(matches[len(matches)-1].Id, true)
+	}
+	return storage.NewCursor(matches[0].Id, false)
+}
+
+// Читает параметр cursor. Возвращает nil, если он не задан. Если он задан неверно,
+// то отвечает ошибкой и возвращает false.
+func parseCursor(c *fasthttp.RequestCtx) (*storage.Cursor, bool) {
+	param := c.QueryArgs().Peek("cursor")
+	if len(param) == 0 {
+		return nil, true
+	}
+	cursor, err := storage.ParseCursor(string(param))
+	if err != nil {
+		c.Error(err.Error(), 400)
+		return nil, false
+	}
+	return &cursor, true
+}
+
+var stateNames = map[string]byte{
+	"win":  types.StateWin,
+	"loss": types.StateLoss,
+	"draw": types.StateDraw,
+}
+
+// Читает параметры from, to и state. Если они заданы неверно, то отвечает ошибкой и возвращает false.
+//
+// state - одно или несколько состояний через запятую: win, loss, draw.
+func parseMatchFilter(c *fasthttp.RequestCtx) (storage.MatchFilter, bool) {
+	var r storage.MatchFilter
+	var ok bool
+	if r.From, ok = parseTime(c.QueryArgs().Peek("from")); !ok {
+		c.Error("invalid from", 400)
+		return r, false
+	}
+	if r.To, ok = parseTime(c.QueryArgs().Peek("to")); !ok {
+		c.Error("invalid to", 400)
+		return r, false
+	}
+	if r.To != 0 && r.From >= r.To {
+		c.Error("from must be before to", 400)
+		return r, false
+	}
+	if param := string(c.QueryArgs().Peek("state")); param != "" {
+		for _, name := range strings.Split(param, ",") {
+			state, ok := stateNames[name]
+			if !ok {
+				c.Error("invalid state", 400)
+				return r, false
+			}
+			r.States |= storage.NewStateSet(state)
+		}
+	}
+	return r, true
 }
 
 func jsonMatches(c *fasthttp.RequestCtx, matches []*types.UserMatch, reverse bool) {
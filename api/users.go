@@ -0,0 +1,114 @@
+package api
+
+import (
+	"encoding/json"
+	"strconv"
+
+	"github.com/VimeWorld/matches-db/storage"
+	"github.com/VimeWorld/matches-db/types"
+	"github.com/valyala/fasthttp"
+)
+
+// Максимальное количество пользователей в одном запросе
+const maxBatchUsers = 100
+
+type usersMatchesRequest struct {
+	Users  []uint32 `json:"users"`
+	Count  *int     `json:"count"`
+	After  uint64   `json:"after"`
+	Before uint64   `json:"before"`
+	// Курсоры из X-Next-Cursors предыдущего ответа по id пользователя, важнее after и before
+	Cursors map[uint32]string `json:"cursors"`
+}
+
+// Возвращает последние матчи сразу нескольких пользователей. Если задан before, то матчи до него,
+// иначе если задан after, то матчи после него.
+//
+// В заголовке X-Next-Cursors всегда отдаются курсоры следующих страниц всех пользователей
+// в виде user=cursor через запятую, как X-Next-Cursor в /user/getMatches.
+func (s *Server) handleUsersMatches(c *fasthttp.RequestCtx) {
+	var req usersMatchesRequest
+	if err := json.Unmarshal(c.PostBody(), &req); err != nil {
+		c.Error(err.Error(), 400)
+		return
+	}
+	count := 20
+	if req.Count != nil {
+		count = *req.Count
+	}
+	if count < 0 {
+		c.Error("invalid count", 400)
+		return
+	}
+	if len(req.Users) == 0 || len(req.Users) > maxBatchUsers {
+		c.Error("users count must be between 1 and "+strconv.Itoa(maxBatchUsers), 400)
+		return
+	}
+	for _, user := range req.Users {
+		if user == 0 {
+			c.Error("invalid user id", 400)
+			return
+		}
+	}
+	cursors := make(map[uint32]storage.Cursor, len(req.Cursors))
+	for user, param := range req.Cursors {
+		cursor, err := storage.ParseCursor(param)
+		if err != nil {
+			c.Error(err.Error(), 400)
+			return
+		}
+		cursors[user] = cursor
+	}
+
+	result := make(map[uint32][]*types.UserMatch, len(req.Users))
+	var next []byte
+	err := s.Users.Transaction(func(txn *storage.UsersTransaction) error {
+		next = next[:0]
+		for _, user := range req.Users {
+			if _, ok := result[user]; ok {
+				continue
+			}
+			var matches []*types.UserMatch
+			var err error
+			from, ok := cursors[user]
+			if ok {
+				matches, err = txn.GetUserMatchesFromCursor(user, from, count, storage.MatchFilter{})
+			} else if req.Before > 0 {
+				from = storage.NewCursor(req.Before, false)
+				matches, err = txn.GetUserMatchesBefore(user, req.Before, count, storage.MatchFilter{})
+			} else if req.After > 0 {
+				from = storage.NewCursor(req.After, true)
+				matches, err = txn.GetUserMatchesAfter(user, req.After, count, storage.MatchFilter{})
+			} else {
+				from = storage.NewCursor(0, false)
+				matches, err = txn.GetLastUserMatches(user, 0, count, storage.MatchFilter{})
+			}
+			if err != nil {
+				return err
+			}
+			if len(next) > 0 {
+				next = append(next, ',')
+			}
+			next = strconv.AppendUint(next, uint64(user), 10)
+			next = append(next, '=')
+			next = append(next, nextCursor(matches, from).String()...)
+			if matches == nil {
+				matches = []*types.UserMatch{}
+			}
+			for i, j := 0, len(matches)-1; i < j; i, j = i+1, j-1 {
+				matches[i], matches[j] = matches[j], matches[i]
+			}
+			result[user] = matches
+		}
+		return nil
+	}, false)
+	if err != nil {
+		c.Error(err.Error(), 500)
+		return
+	}
+
+	c.Response.Header.SetBytesV("X-Next-Cursors", next)
+	c.Response.Header.Set("Content-Type", "application/json")
+	bytes, _ := json.Marshal(result)
+	_, _ = c.Write(bytes)
+}
@@ -1,7 +1,11 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
 	"flag"
+	"fmt"
 	"log"
 	"os"
 	"os/signal"
@@ -10,6 +14,7 @@ import (
 
 	"github.com/VimeWorld/matches-db/api"
 	"github.com/VimeWorld/matches-db/storage"
+	"github.com/dgraph-io/badger/v4"
 	"github.com/vharitonsky/iniflags"
 )
 
@@ -17,9 +22,18 @@ func main() {
 	bind := flag.String("bind", "127.0.0.1:8881", "address to bind baas (can be a unix domain socket: /var/run/matches-db.sock)")
 	dir := flag.String("dir", "./db", "path to the database")
 	ttl := flag.Duration("ttl", 6*30*24*time.Hour, "matches ttl")
+	allTimeStats := flag.Bool("stats-alltime", false, "keep user stats for all time instead of only for stored matches")
+	writeLocked := flag.Bool("write-locked", false, "start in maintenance mode, rejecting match writes until /manage/unlock")
 
 	iniflags.Parse()
 
+	if flag.Arg(0) == "restore" {
+		if err := restore(*dir, flag.Args()[1:]); err != nil {
+			log.Printf("Could not restore database: %s", err)
+		}
+		return
+	}
+
 	db, err := storage.OpenDatabase(*dir)
 	if err != nil {
 		log.Printf("Could not open users database: %s", err)
@@ -27,25 +41,111 @@ func main() {
 	}
 	defer func() { _ = db.Close() }()
 
+	writes := &storage.WriteLock{}
+	if *writeLocked {
+		writes.Lock()
+	}
 	users := &storage.UserStorage{
-		DB:  db,
-		TTL: *ttl,
+		DB:           db,
+		TTL:          *ttl,
+		AllTimeStats: *allTimeStats,
+		Writes:       writes,
 	}
 	users.Init()
 
+	if err := storage.Migrate(db, users); err != nil {
+		log.Printf("Could not migrate database: %s", err)
+		return
+	}
+
 	matches := &storage.MatchesStorage{
-		DB:  db,
-		TTL: *ttl + 10*24*time.Hour,
+		DB:     db,
+		TTL:    *ttl + 10*24*time.Hour,
+		Users:  users,
+		Writes: writes,
+	}
+	if err := matches.Init(); err != nil {
+		log.Printf("Could not load zstd dictionaries: %s", err)
+		return
 	}
 
+	switch command := flag.Arg(0); command {
+	case "", "serve":
+		serve(*bind, db, users, matches)
+	case "sort-buckets":
+		fixed, err := users.SortBuckets()
+		if err != nil {
+			log.Printf("Could not sort buckets: %s", err)
+			return
+		}
+		log.Printf("Sorted %d buckets", fixed)
+	case "reindex":
+		cmd := flag.NewFlagSet("reindex", flag.ExitOnError)
+		rate := cmd.Int("rate", 0, "max matches per second, 0 for unlimited")
+		_ = cmd.Parse(flag.Args()[1:])
+		lastLog := time.Now()
+		err := matches.Reindex(context.Background(), storage.ReindexOptions{
+			Rate: *rate,
+			Progress: func(processed, total int64) {
+				if time.Since(lastLog) > 5*time.Second || processed == total {
+					log.Printf("Reindexed %d/%d matches", processed, total)
+					lastLog = time.Now()
+				}
+			},
+		})
+		if err != nil {
+			log.Printf("Could not reindex: %s", err)
+		}
+	case "train-dictionary":
+		cmd := flag.NewFlagSet("train-dictionary", flag.ExitOnError)
+		samples := cmd.Int("samples", 1000, "number of matches to train on")
+		_ = cmd.Parse(flag.Args()[1:])
+		id, err := matches.TrainDictionary(*samples)
+		if err != nil {
+			log.Printf("Could not train dictionary: %s", err)
+			return
+		}
+		log.Printf("Trained zstd dictionary %d", id)
+	case "recompress":
+		lastLog := time.Now()
+		recompressed, err := matches.Recompress(context.Background(), func(processed, total int64) {
+			if time.Since(lastLog) > 5*time.Second || processed == total {
+				log.Printf("Processed %d/%d matches", processed, total)
+				lastLog = time.Now()
+			}
+		})
+		if err != nil {
+			log.Printf("Could not recompress: %s", err)
+			return
+		}
+		log.Printf("Recompressed %d matches", recompressed)
+	case "verify":
+		cmd := flag.NewFlagSet("verify", flag.ExitOnError)
+		fix := cmd.Bool("fix", false, "fix found problems")
+		_ = cmd.Parse(flag.Args()[1:])
+		report, err := users.Verify(context.Background(), *fix, func(processed int64) {
+			log.Printf("Verified %d keys", processed)
+		})
+		if err != nil {
+			log.Printf("Could not verify: %s", err)
+			return
+		}
+		bytes, _ := json.MarshalIndent(report, "", "  ")
+		log.Printf("Report: %s", bytes)
+	default:
+		log.Printf("Unknown command: %s", command)
+	}
+}
+
+func serve(bind string, db *badger.DB, users *storage.UserStorage, matches *storage.MatchesStorage) {
 	server := api.Server{
 		Users:   users,
 		Matches: matches,
 	}
 
 	go func() {
-		log.Printf("Start http server on %s", *bind)
-		if err := server.Bind(*bind); err != nil {
+		log.Printf("Start http server on %s", bind)
+		if err := server.Bind(bind); err != nil {
 			log.Printf("Could not start server: %s", err)
 		}
 	}()
@@ -64,3 +164,38 @@ func main() {
 		}
 	}
 }
+
+// Загружает в пустую базу полный бэкап и, по желанию, инкрементальные бэкапы после него, в порядке их создания.
+func restore(dir string, files []string) error {
+	if len(files) == 0 {
+		return errors.New("usage: restore <backup> [incremental backups...]")
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("directory %s is not empty", dir)
+	}
+
+	db, err := storage.OpenDatabase(dir)
+	if err != nil {
+		return err
+	}
+	defer func() { _ = db.Close() }()
+
+	for _, file := range files {
+		log.Printf("Loading %s", file)
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		err = db.Load(f, 256)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	log.Printf("Restored %d backups", len(files))
+	return nil
+}
@@ -0,0 +1,192 @@
+package storage
+
+import (
+	"encoding/json"
+
+	"github.com/VimeWorld/matches-db/types"
+	"github.com/dgraph-io/badger/v4"
+)
+
+type BulkMatch struct {
+	Id    uint64
+	Data  []byte
+	Match *types.Match
+}
+
+type bulkValue struct {
+	value   []byte
+	config  *valueDescriptor
+	changed bool
+}
+
+// Сохраняет пачку матчей через badger.WriteBatch. Для каждого матча возвращает true, если он был создан.
+//
+// Сначала в одной транзакции на чтение считываются старые тела матчей и все затронутые бакеты,
+// изменения применяются в памяти, так что каждый ключ пользователя записывается один раз на пачку.
+// WriteBatch не проверяет конфликты, поэтому параллельные записи тех же пользователей
+// во время загрузки могут потеряться. Метод предназначен для заливки истории.
+func (s *MatchesStorage) SaveBulk(matches []*BulkMatch) ([]bool, error) {
+	created := make([]bool, len(matches))
+	values := make(map[string]*bulkValue)
+	users := s.Users
+
+	err := s.DB.View(func(txn *badger.Txn) error {
+		load := func(key []byte, config *valueDescriptor) (*bulkValue, error) {
+			if v, ok := values[string(key)]; ok {
+				return v, nil
+			}
+			v := &bulkValue{config: config}
+			stored, version, err := getWithValue(txn, key)
+			if err == nil {
+				if v.value, v.changed, err = config.read(stored, version); err != nil {
+					return nil, err
+				}
+			} else if err != badger.ErrKeyNotFound {
+				return nil, err
+			}
+			values[string(key)] = v
+			return v, nil
+		}
+
+		updateStats := func(user uint32, bucket uint32, id uint64, oldState, newState int, bucketMatches []byte) error {
+			if oldState == newState {
+				return nil
+			}
+			stats, err := load(userStatsKey(user), users.statsDescriptor)
+			if err != nil {
+				return err
+			}
+			stats.value, err = applyStats(stats.value, bucket, id, oldState, newState, func() ([]byte, error) {
+				return bucketMatches, nil
+			})
+			stats.changed = true
+			return err
+		}
+
+		batchStates := make(map[uint64]map[uint32]byte)
+		for i, m := range matches {
+			oldStates, ok := batchStates[m.Id]
+			if !ok {
+				old, err := s.getMatch(txn, m.Id)
+				if err != nil {
+					return err
+				}
+				if old != nil {
+					var oldMatch types.Match
+					if err = json.Unmarshal(old, &oldMatch); err != nil {
+						return err
+					}
+					oldStates = oldMatch.GetStates()
+				} else {
+					created[i] = true
+				}
+			}
+
+			states := m.Match.GetStates()
+			bucketNum := getBucketNumberFromId(m.Id)
+			for user := range oldStates {
+				if _, ok := states[user]; ok {
+					continue
+				}
+				v, err := load(userMatchesKey(user, bucketNum), users.userMatchesDescriptor)
+				if err != nil {
+					return err
+				}
+				var removed []byte
+				v.value, removed = removeChunks(v.value, serializeUint64(m.Id), true, matchSize)
+				if removed == nil {
+					continue
+				}
+				v.changed = true
+				if err = updateStats(user, bucketNum, m.Id, int(removed[8]), noState, v.value); err != nil {
+					return err
+				}
+			}
+			for user, state := range states {
+				v, err := load(userMatchesKey(user, bucketNum), users.userMatchesDescriptor)
+				if err != nil {
+					return err
+				}
+				var previous []byte
+				var inserted bool
+				v.value, previous, inserted = insertSorted(v.value, serializeMatch(m.Id, state), 8, matchSize)
+				v.changed = v.changed || inserted
+				oldState := noState
+				if previous != nil {
+					oldState = int(previous[8])
+				}
+				if err = updateStats(user, bucketNum, m.Id, oldState, int(state), v.value); err != nil {
+					return err
+				}
+			}
+			batchStates[m.Id] = states
+		}
+
+		// Обновляем количество матчей в индексах пользователей, опустевшие бакеты убираются из индекса
+		for key, v := range values {
+			if key[0] != keyPrefixUserMatches || !v.changed {
+				continue
+			}
+			user := byteOrder.Uint32([]byte(key[prefixLength:]))
+			bucket := byteOrder.Uint32([]byte(key[prefixLength+keyLength:]))
+			index, err := load(userBucketsKey(user), users.bucketsDescriptor)
+			if err != nil {
+				return err
+			}
+			if len(v.value) == 0 {
+				var removed []byte
+				index.value, removed = removeChunks(index.value, serializeUint32(bucket), false, bucketIndexSize)
+				index.changed = index.changed || removed != nil
+			} else {
+				var changed bool
+				index.value, _, changed = insertSorted(index.value, serializeBucketIndex(bucket, len(v.value)/matchSize), bucketLength, bucketIndexSize)
+				index.changed = index.changed || changed
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	wb := s.DB.NewWriteBatch()
+	defer wb.Cancel()
+	sizes := &pendingSizes{}
+	for _, m := range matches {
+		entry, err := s.newEntry(m.Id, m.Data)
+		if err != nil {
+			return nil, err
+		}
+		sizes.addMatch(len(m.Data), entry)
+		if err = wb.SetEntry(entry); err != nil {
+			return nil, err
+		}
+	}
+	for key, v := range values {
+		if !v.changed {
+			continue
+		}
+		value := v.value
+		switch key[0] {
+		case keyPrefixUserBuckets:
+			value = users.filterOldBuckets(value)
+		case keyPrefixUserStats:
+			value = users.filterOldStats(value)
+		}
+		if len(value) == 0 {
+			err = wb.Delete([]byte(key))
+		} else {
+			e := v.config.entry([]byte(key), value)
+			sizes.add(v.config.sizes, len(e.Value))
+			err = wb.SetEntry(e)
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+	if err = wb.Flush(); err != nil {
+		return nil, err
+	}
+	sizes.observe()
+	return created, nil
+}
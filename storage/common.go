@@ -0,0 +1,141 @@
+package storage
+
+import (
+	"github.com/VimeWorld/matches-db/types"
+	"github.com/dgraph-io/badger/v4"
+)
+
+func (s *UserStorage) GetCommonMatches(userid, other uint32, after, before uint64, count int, r MatchFilter) ([]*types.CommonMatch, error) {
+	var matches []*types.CommonMatch
+	err := s.Transaction(func(txn *UsersTransaction) error {
+		m, err := txn.GetCommonMatches(userid, other, after, before, count, r)
+		matches = m
+		return err
+	}, false)
+	return matches, err
+}
+
+// Возвращает до count общих матчей двух пользователей с id в интервале (after, before), отсортированных по id.
+// Нулевая граница не ограничивает выборку, r дополнительно ограничивает ее по времени и состоянию пользователя userid.
+// Если задан только after, то берутся ближайшие к нему матчи, иначе ближайшие к before.
+//
+// Тела матчей не читаются: пересекаются индексы бакетов, а затем сами бакеты обоих пользователей.
+func (t *UsersTransaction) GetCommonMatches(userid, other uint32, after, before uint64, count int, r MatchFilter) ([]*types.CommonMatch, error) {
+	if count <= 0 {
+		return nil, nil
+	}
+	buckets, err := t.getCommonBuckets(userid, other, after, before, r)
+	if err != nil {
+		return nil, err
+	}
+
+	forward := after > 0 && before == 0
+	var matches []*types.CommonMatch
+	for i := range buckets {
+		bucket := buckets[i]
+		if !forward {
+			bucket = buckets[len(buckets)-1-i]
+		}
+		temp, err := t.intersectBucket(userid, other, bucket, after, before, r)
+		if err != nil {
+			return nil, err
+		}
+		need := count - len(matches)
+		if forward {
+			if len(temp) > need {
+				temp = temp[:need]
+			}
+			matches = append(matches, temp...)
+		} else {
+			if len(temp) > need {
+				temp = temp[len(temp)-need:]
+			}
+			matches = append(temp, matches...)
+		}
+		if len(matches) >= count {
+			break
+		}
+	}
+	return matches, nil
+}
+
+// Пересекает отсортированные индексы бакетов двух пользователей с учетом интервала и TTL.
+func (t *UsersTransaction) getCommonBuckets(userid, other uint32, after, before uint64, r MatchFilter) ([]uint32, error) {
+	first, err := t.getBuckets(userBucketsKey(userid))
+	if err != nil || len(first) == 0 {
+		return nil, err
+	}
+	second, err := t.getBuckets(userBucketsKey(other))
+	if err != nil || len(second) == 0 {
+		return nil, err
+	}
+
+	fromBucket := t.s.oldestBucketNum()
+	if after > 0 {
+		if num := getBucketNumberFromId(after); num > fromBucket {
+			fromBucket = num
+		}
+	}
+	rangeFrom, toBucket := r.buckets()
+	if fromBucket < rangeFrom {
+		fromBucket = rangeFrom
+	}
+	if before > 0 {
+		if num := getBucketNumberFromId(before); num < toBucket {
+			toBucket = num
+		}
+	}
+
+	var common []uint32
+	for i, j := 0, 0; i < len(first) && j < len(second); {
+		a, b := byteOrder.Uint32(first[i]), byteOrder.Uint32(second[j])
+		if a < b {
+			i++
+		} else if a > b {
+			j++
+		} else {
+			if a >= fromBucket && a <= toBucket {
+				common = append(common, a)
+			}
+			i++
+			j++
+		}
+	}
+	return common, nil
+}
+
+func (t *UsersTransaction) intersectBucket(userid, other uint32, bucket uint32, after, before uint64, r MatchFilter) ([]*types.CommonMatch, error) {
+	first, err := t.s.userMatchesDescriptor.get(t.txn, userMatchesKey(userid, bucket))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	second, err := t.s.userMatchesDescriptor.get(t.txn, userMatchesKey(other, bucket))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+
+	var matches []*types.CommonMatch
+	for i, j := 0, 0; i+matchSize <= len(first) && j+matchSize <= len(second); {
+		a, b := byteOrder.Uint64(first[i:]), byteOrder.Uint64(second[j:])
+		if a < b {
+			i += matchSize
+		} else if a > b {
+			j += matchSize
+		} else {
+			if a > after && (before == 0 || a < before) && r.contains(a) && r.States.Contains(first[i+8]) {
+				matches = append(matches, &types.CommonMatch{
+					Id:         a,
+					State:      first[i+8],
+					OtherState: second[j+8],
+				})
+			}
+			i += matchSize
+			j += matchSize
+		}
+	}
+	return matches, nil
+}
@@ -0,0 +1,52 @@
+package storage
+
+import (
+	"encoding/base64"
+	"errors"
+
+	"github.com/VimeWorld/matches-db/types"
+)
+
+const cursorSize = 1 + 8
+
+var errInvalidCursor = errors.New("invalid cursor")
+
+// Позиция в истории матчей пользователя: последний отданный матч и направление.
+// Следующая страница начинается строго после Id, поэтому новые матчи не сдвигают страницы.
+// Бакет, с которого начинается поиск, считается по Id, поэтому в токен он не пишется.
+type Cursor struct {
+	Id      uint64
+	Forward bool
+}
+
+func NewCursor(id uint64, forward bool) Cursor {
+	return Cursor{Id: id, Forward: forward}
+}
+
+func (c Cursor) String() string {
+	buf := make([]byte, cursorSize)
+	if c.Forward {
+		buf[0] = 1
+	}
+	byteOrder.PutUint64(buf[1:], c.Id)
+	return base64.RawURLEncoding.EncodeToString(buf)
+}
+
+func ParseCursor(s string) (Cursor, error) {
+	buf, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil || len(buf) != cursorSize || buf[0] > 1 {
+		return Cursor{}, errInvalidCursor
+	}
+	return Cursor{
+		Forward: buf[0] == 1,
+		Id:      byteOrder.Uint64(buf[1:]),
+	}, nil
+}
+
+// Возвращает следующую страницу после курсора, отсортированную по id
+func (t *UsersTransaction) GetUserMatchesFromCursor(userid uint32, cursor Cursor, count int, r MatchFilter) ([]*types.UserMatch, error) {
+	if cursor.Forward {
+		return t.GetUserMatchesAfter(userid, cursor.Id, count, r)
+	}
+	return t.GetUserMatchesBefore(userid, cursor.Id, count, r)
+}
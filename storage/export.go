@@ -0,0 +1,68 @@
+package storage
+
+import (
+	"context"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/dgraph-io/ristretto/z"
+)
+
+// Количество младших бит id, которые не входят в префикс окна выгрузки.
+// Одно окно покрывает 2^26 мс снежинки, это примерно 18.6 часов.
+const exportWindowShift = 48
+
+// Выгружает все живые матчи с id в диапазоне [from, to] через badger.Stream.
+//
+// Stream не сохраняет порядок ключей, поэтому выгрузка идет окнами по старшим 16 битам id.
+// send вызывается для каждого матча с распакованным телом, а checkpoint вызывается после того,
+// как окно выгружено целиком, с id, с которого можно продолжить выгрузку.
+func (s *MatchesStorage) Export(ctx context.Context, from, to uint64, send func(id uint64, data []byte) error, checkpoint func(next uint64) error) error {
+	for from <= to {
+		next, err := s.nextMatchIds(matchKey(from), 1)
+		if err != nil {
+			return err
+		}
+		if len(next) == 0 || next[0] > to {
+			return nil
+		}
+
+		window := next[0] >> exportWindowShift
+		stream := s.DB.NewStream()
+		stream.LogPrefix = "Export"
+		stream.Prefix = []byte{keyPrefixMatch, byte(window >> 8), byte(window)}
+		stream.ChooseKey = func(item *badger.Item) bool {
+			id := byteOrder.Uint64(item.Key()[prefixLength:])
+			return id >= from && id <= to
+		}
+		stream.Send = func(buf *z.Buffer) error {
+			list, err := badger.BufferToKVList(buf)
+			if err != nil {
+				return err
+			}
+			for _, kv := range list.Kv {
+				data := kv.Value
+				if len(kv.UserMeta) > 0 && kv.UserMeta[0] != matchesMetaTypeRaw {
+					if data, err = s.decode(kv.UserMeta[0], data); err != nil {
+						return err
+					}
+				}
+				if err = send(byteOrder.Uint64(kv.Key[prefixLength:]), data); err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+		if err = stream.Orchestrate(ctx); err != nil {
+			return err
+		}
+
+		if window+1 >= 1<<(64-exportWindowShift) {
+			return nil
+		}
+		from = (window + 1) << exportWindowShift
+		if err = checkpoint(from); err != nil {
+			return err
+		}
+	}
+	return nil
+}
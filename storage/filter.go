@@ -0,0 +1,106 @@
+package storage
+
+import (
+	"sort"
+	"time"
+
+	"github.com/VimeWorld/matches-db/types"
+)
+
+// Фильтр выборки матчей пользователя.
+//
+// From и To ограничивают время матча в unix миллисекундах, From включительно, To не включительно.
+// Нулевое значение границы ее не ограничивает. States - набор состояний пользователя в матче,
+// пустой набор пропускает все состояния.
+type MatchFilter struct {
+	From   uint64
+	To     uint64
+	States StateSet
+}
+
+// Набор состояний матча, бит 1<<state для каждого состояния
+type StateSet uint8
+
+func NewStateSet(states ...byte) StateSet {
+	var set StateSet
+	for _, state := range states {
+		set |= 1 << state
+	}
+	return set
+}
+
+func (s StateSet) Contains(state byte) bool {
+	return s == 0 || s&(1<<state) != 0
+}
+
+func (r MatchFilter) empty() bool {
+	return r.From == 0 && r.To == 0 && r.States == 0
+}
+
+// Границы по snowflake id: id матча должен быть в [minId, maxId)
+func (r MatchFilter) ids() (minId, maxId uint64) {
+	maxId = ^uint64(0)
+	if r.From > types.SnowflakeEpoch {
+		minId = (r.From - types.SnowflakeEpoch) << 22
+	}
+	if r.To != 0 {
+		maxId = 0
+		if r.To > types.SnowflakeEpoch {
+			maxId = (r.To - types.SnowflakeEpoch) << 22
+		}
+	}
+	return
+}
+
+// Номера первого и последнего бакета, в которых могут быть матчи из интервала
+func (r MatchFilter) buckets() (from, to uint32) {
+	to = ^uint32(0)
+	if r.From != 0 {
+		from = getBucketNumberFromMillis(time.Duration(r.From) * time.Millisecond)
+	}
+	if r.To != 0 {
+		to = getBucketNumberFromMillis(time.Duration(r.To-1) * time.Millisecond)
+	}
+	return
+}
+
+// Проходят ли фильтр все матчи бакета
+func (r MatchFilter) coversBucket(bucket uint32) bool {
+	from, to := r.buckets()
+	return r.States == 0 && (r.From == 0 || bucket > from) && (r.To == 0 || bucket < to)
+}
+
+func (r MatchFilter) contains(id uint64) bool {
+	minId, maxId := r.ids()
+	return id >= minId && id < maxId
+}
+
+// Оставляет в отсортированном бакете пользователя только матчи, которые проходят фильтр.
+// Если отфильтрованы состояния, то возвращается копия.
+func (r MatchFilter) trim(value []byte) []byte {
+	if r.empty() {
+		return value
+	}
+	minId, maxId := r.ids()
+	count := len(value) / matchSize
+	from := sort.Search(count, func(idx int) bool {
+		return byteOrder.Uint64(value[idx*matchSize:]) >= minId
+	})
+	to := sort.Search(count, func(idx int) bool {
+		return byteOrder.Uint64(value[idx*matchSize:]) >= maxId
+	})
+	if to < from {
+		to = from
+	}
+	value = value[from*matchSize : to*matchSize]
+	if r.States == 0 {
+		return value
+	}
+	filtered := make([]byte, 0, len(value))
+	for i := 0; i+matchSize <= len(value); i += matchSize {
+		if r.States.Contains(value[i+8]) {
+			filtered = append(filtered, value[i:i+matchSize]...)
+		}
+	}
+	return filtered
+}
@@ -0,0 +1,51 @@
+package storage
+
+// Каждый тип данных хранится под своим однобайтным префиксом.
+//
+// Раньше тела матчей и бакеты пользователей хранились под 8-байтными ключами
+// без префикса, поэтому id матча мог совпасть с ключом userid||bucket и перезаписать его.
+const (
+	keyPrefixMatch       = byte(1)
+	keyPrefixUserBuckets = byte(2)
+	keyPrefixUserMatches = byte(3)
+	keyPrefixMeta        = byte(4)
+	keyPrefixUserStats   = byte(5)
+)
+
+const prefixLength = 1
+
+func matchKey(id uint64) []byte {
+	k := make([]byte, prefixLength+8)
+	k[0] = keyPrefixMatch
+	byteOrder.PutUint64(k[prefixLength:], id)
+	return k
+}
+
+func userBucketsKey(userid uint32) []byte {
+	k := make([]byte, prefixLength+keyLength)
+	k[0] = keyPrefixUserBuckets
+	byteOrder.PutUint32(k[prefixLength:], userid)
+	return k
+}
+
+func userMatchesKey(userid uint32, bucket uint32) []byte {
+	k := make([]byte, prefixLength+keyLength+bucketLength)
+	k[0] = keyPrefixUserMatches
+	byteOrder.PutUint32(k[prefixLength:], userid)
+	byteOrder.PutUint32(k[prefixLength+keyLength:], bucket)
+	return k
+}
+
+func userStatsKey(userid uint32) []byte {
+	k := make([]byte, prefixLength+keyLength)
+	k[0] = keyPrefixUserStats
+	byteOrder.PutUint32(k[prefixLength:], userid)
+	return k
+}
+
+func metaKey(name string) []byte {
+	k := make([]byte, prefixLength+len(name))
+	k[0] = keyPrefixMeta
+	copy(k[prefixLength:], name)
+	return k
+}
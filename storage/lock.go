@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"errors"
+	"sync"
+	"sync/atomic"
+)
+
+var ErrWriteLocked = errors.New("database is locked for maintenance")
+
+// Режим обслуживания, в котором новые записи отклоняются, а чтение продолжает работать.
+//
+// Каждая запись выполняется между Begin и Done, поэтому Lock может дождаться тех, что уже начались.
+// Один WriteLock общий для хранилищ матчей и пользователей.
+type WriteLock struct {
+	locked atomic.Bool
+	mu     sync.RWMutex
+}
+
+func (l *WriteLock) Locked() bool {
+	return l.locked.Load()
+}
+
+// Включает режим обслуживания и ждет завершения всех начатых записей
+func (l *WriteLock) Lock() {
+	l.locked.Store(true)
+	// Lock получится взять, только когда все начатые записи отпустят RLock
+	l.mu.Lock()
+	l.mu.Unlock()
+}
+
+func (l *WriteLock) Unlock() {
+	l.locked.Store(false)
+}
+
+// Начинает запись. Не ждет: возвращает false, если включен режим обслуживания или Lock
+// еще ждет начатые записи, иначе после записи нужно вызвать Done.
+func (l *WriteLock) Begin() bool {
+	if l.locked.Load() || !l.mu.TryRLock() {
+		return false
+	}
+	if l.locked.Load() {
+		l.mu.RUnlock()
+		return false
+	}
+	return true
+}
+
+func (l *WriteLock) Done() {
+	l.mu.RUnlock()
+}
+
+// Выполняет fn как запись. Возвращает ErrWriteLocked, если включен режим обслуживания.
+func (l *WriteLock) Run(fn func() error) error {
+	if !l.Begin() {
+		return ErrWriteLocked
+	}
+	defer l.Done()
+	return fn()
+}
@@ -2,45 +2,140 @@ package storage
 
 import (
 	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/adler32"
 	"io"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/VimeWorld/matches-db/types"
+	"github.com/cespare/xxhash/v2"
 	"github.com/dgraph-io/badger/v4"
 	"github.com/klauspost/compress/flate"
 )
 
 const (
-	matchesMetaTypeRaw   = byte(0)
+	matchesMetaTypeRaw = byte(0)
+	// Сырой поток deflate. Так матчи сжимались раньше, новые сохраняются в zlib
 	matchesMetaTypeFlate = byte(1)
+	// Сжато zstd со словарем, id словаря записан в заголовке фрейма
+	matchesMetaTypeZstd = byte(2)
+	// Поток zlib: заголовок, deflate и Adler-32 распакованного тела. Именно его HTTP называет
+	// кодировкой deflate, поэтому он отдается клиентам без распаковки.
+	matchesMetaTypeZlib = byte(3)
+
+	// Флаг в UserMeta: значение начинается с 8 байт xxhash распакованного тела.
+	// Матчи, сохраненные до появления хэша, его не имеют.
+	matchesMetaHashed = byte(0x80)
 )
 
 type MatchesStorage struct {
-	TTL         time.Duration
-	WriteLocked bool
+	TTL time.Duration
+	// Режим обслуживания, в котором API и задачи обслуживания не пишут в базу, а чтение продолжает работать
+	Writes *WriteLock
+
+	DB    *badger.DB
+	Users *UserStorage
+
+	zstd atomic.Pointer[zstdCodec]
+}
 
-	DB *badger.DB
+// Загружает сохраненные словари zstd
+func (s *MatchesStorage) Init() error {
+	return s.loadDictionaries()
 }
 
 func (s *MatchesStorage) Get(id uint64) ([]byte, error) {
 	var data []byte
 	err := s.DB.View(func(txn *badger.Txn) error {
-		item, err := txn.Get(serializeUint64(id))
+		var err error
+		data, err = s.getMatch(txn, id)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Кодировки, в которых GetRaw отдает тело матча
+const (
+	EncodingIdentity = ""
+	// Поток zlib, как требует RFC 9110 для Content-Encoding: deflate
+	EncodingDeflate = "deflate"
+)
+
+type RawMatch struct {
+	Data []byte
+	// Кодировка Data: EncodingIdentity или EncodingDeflate
+	Encoding string
+	// xxhash распакованного тела
+	Hash uint64
+}
+
+// Читает тело матча без распаковки, если оно хранится в zlib и acceptDeflate равен true.
+// Иначе тело распаковывается и возвращается с EncodingIdentity. Если матча нет, то возвращает nil.
+//
+// Если notModified вернет true для хэша матча, то тело не читается и возвращается RawMatch
+// только с Hash. Для матчей, сохраненных без хэша, он считается по распакованному телу,
+// пока Recompress не допишет его.
+func (s *MatchesStorage) GetRaw(id uint64, acceptDeflate bool, notModified func(hash uint64) bool) (*RawMatch, error) {
+	var match *RawMatch
+	err := s.DB.View(func(txn *badger.Txn) error {
+		item, err := txn.Get(matchKey(id))
 		if err == badger.ErrKeyNotFound {
 			return nil
+		} else if err != nil {
+			return err
 		}
-		if err == nil {
-			switch item.UserMeta() {
-			case matchesMetaTypeFlate:
-				err = item.Value(func(val []byte) error {
-					data, err = inflate(val)
+		meta := item.UserMeta()
+		return item.Value(func(val []byte) error {
+			hash, body, hashed, err := splitMatchHash(meta, val)
+			if err != nil {
+				return err
+			}
+			m := &RawMatch{Hash: hash}
+			match = m
+			if hashed && notModified(hash) {
+				return nil
+			}
+			if acceptDeflate && meta&^matchesMetaHashed == matchesMetaTypeZlib {
+				m.Data = append([]byte(nil), body...)
+				m.Encoding = EncodingDeflate
+			} else {
+				if m.Data, err = s.decode(meta, val); err != nil {
 					return err
-				})
-			case matchesMetaTypeRaw:
-				data, err = item.ValueCopy(nil)
+				}
+				if !hashed {
+					m.Hash = xxhash.Sum64(m.Data)
+					if notModified(m.Hash) {
+						m.Data = nil
+					}
+				}
+			}
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, err
+	}
+	return match, nil
+}
+
+// Читает тела матчей в одной транзакции. Для отсутствующих матчей в результате nil.
+func (s *MatchesStorage) GetMany(ids []uint64) ([][]byte, error) {
+	data := make([][]byte, len(ids))
+	err := s.DB.View(func(txn *badger.Txn) error {
+		for i, id := range ids {
+			var err error
+			if data[i], err = s.getMatch(txn, id); err != nil {
+				return err
 			}
 		}
-		return err
+		return nil
 	})
 	if err != nil {
 		return nil, err
@@ -48,8 +143,9 @@ func (s *MatchesStorage) Get(id uint64) ([]byte, error) {
 	return data, nil
 }
 
-func (s *MatchesStorage) Transaction(fn func(txn *MatchesTransaction) error) error {
-	return s.DB.Update(func(txn *badger.Txn) error {
+// Выполняет fn в транзакции на чтение
+func (s *MatchesStorage) View(fn func(txn *MatchesTransaction) error) error {
+	return s.DB.View(func(txn *badger.Txn) error {
 		return fn(&MatchesTransaction{
 			txn: txn,
 			s:   s,
@@ -57,29 +153,200 @@ func (s *MatchesStorage) Transaction(fn func(txn *MatchesTransaction) error) err
 	})
 }
 
+// Выполняет fn в транзакции на запись. При конфликте с параллельной транзакцией fn будет вызван повторно.
+func (s *MatchesStorage) Transaction(fn func(txn *MatchesTransaction) error) error {
+	sizes := &pendingSizes{}
+	err := updateWithRetry(s.DB, func(txn *badger.Txn) error {
+		sizes.reset()
+		return fn(&MatchesTransaction{
+			txn:   txn,
+			s:     s,
+			sizes: sizes,
+		})
+	})
+	if err != nil {
+		return err
+	}
+	sizes.observe()
+	return nil
+}
+
 type MatchesTransaction struct {
-	txn *badger.Txn
-	s   *MatchesStorage
+	txn   *badger.Txn
+	s     *MatchesStorage
+	sizes *pendingSizes
 }
 
-func (t *MatchesTransaction) Put(id uint64, data []byte, copy bool) error {
-	meta := matchesMetaTypeRaw
-	// Все что хранится в LSM сжимается автоматически
-	if len(data) > int(t.s.DB.Opts().ValueThreshold) {
+func (t *MatchesTransaction) Put(id uint64, data []byte) error {
+	entry, err := t.s.newEntry(id, data)
+	if err != nil {
+		return err
+	}
+	t.sizes.addMatch(len(data), entry)
+	return t.txn.SetEntry(entry)
+}
+
+// Выбирает, в каком виде хранить тело матча размера size. Это единственное место, где выбирается формат:
+//   - тела больше ValueThreshold хранятся в zlib, чтобы GetRaw отдавал их клиентам без распаковки;
+//   - меньшие тела хранятся в LSM, который сжимает блоки сам, но на маленьких телах это почти
+//     ничего не дает, поэтому если загружен словарь, они сжимаются zstd;
+//   - без словаря меньшие тела хранятся как есть.
+func (s *MatchesStorage) matchType(size int, codec *zstdCodec) byte {
+	if size > int(s.DB.Opts().ValueThreshold) {
+		return matchesMetaTypeZlib
+	}
+	if codec != nil {
+		return matchesMetaTypeZstd
+	}
+	return matchesMetaTypeRaw
+}
+
+// Создает запись тела матча. Значение всегда копируется, поэтому data можно переиспользовать.
+func (s *MatchesStorage) newEntry(id uint64, data []byte) (*badger.Entry, error) {
+	codec := s.zstd.Load()
+	typ := s.matchType(len(data), codec)
+	value := make([]byte, 8, 8+len(data))
+	byteOrder.PutUint64(value, xxhash.Sum64(data))
+	switch typ {
+	case matchesMetaTypeZlib:
 		var err error
-		if data, err = deflate(data); err != nil {
-			return err
+		if value, err = deflateZlib(value, data); err != nil {
+			return nil, err
 		}
-		meta = matchesMetaTypeFlate
-	} else if copy {
-		var c []byte
-		data = append(c, data...)
+	case matchesMetaTypeZstd:
+		value = codec.encoder.EncodeAll(data, value)
+	default:
+		value = append(value, data...)
 	}
-	return t.txn.SetEntry(
-		badger.NewEntry(serializeUint64(id), data).
-			WithTTL(t.s.TTL).
-			WithMeta(meta),
-	)
+	return badger.NewEntry(matchKey(id), value).
+		WithTTL(s.TTL).
+		WithMeta(typ | matchesMetaHashed), nil
+}
+
+// Сохраняет тело матча и обновляет индексы всех участников в этой же транзакции.
+// Участники, которых больше нет в матче, удаляются из индексов.
+//
+// Возвращает true, если матч был создан, и false, если он уже существовал и был обновлен.
+func (t *MatchesTransaction) Save(id uint64, data []byte, match *types.Match) (bool, error) {
+	old, err := t.Get(id)
+	if err != nil {
+		return false, err
+	}
+	if err = t.Put(id, data); err != nil {
+		return false, err
+	}
+
+	users := t.Users()
+	states := match.GetStates()
+	if old != nil {
+		var oldMatch types.Match
+		if err = json.Unmarshal(old, &oldMatch); err != nil {
+			return false, err
+		}
+		for user := range oldMatch.GetStates() {
+			if _, ok := states[user]; ok {
+				continue
+			}
+			if err = users.RemoveMatch(user, id); err != nil {
+				return false, err
+			}
+		}
+	}
+	for user, state := range states {
+		if err = users.AddMatch(user, id, state); err != nil {
+			return false, err
+		}
+	}
+	return old == nil, nil
+}
+
+func (t *MatchesTransaction) Get(id uint64) ([]byte, error) {
+	return t.s.getMatch(t.txn, id)
+}
+
+// Удаляет матч и убирает его из индексов всех участников.
+//
+// Возвращает false, если матча не существует.
+func (t *MatchesTransaction) Delete(id uint64) (bool, error) {
+	data, err := t.Get(id)
+	if err != nil || data == nil {
+		return false, err
+	}
+	var match types.Match
+	if err = json.Unmarshal(data, &match); err != nil {
+		return false, err
+	}
+	users := t.Users()
+	for _, player := range match.Players {
+		if err = users.RemoveMatch(player.Id, id); err != nil {
+			return false, err
+		}
+	}
+	return true, t.txn.Delete(matchKey(id))
+}
+
+// Индексы пользователей в той же транзакции
+func (t *MatchesTransaction) Users() *UsersTransaction {
+	return &UsersTransaction{
+		s:     t.s.Users,
+		txn:   t.txn,
+		sizes: t.sizes,
+	}
+}
+
+func (s *MatchesStorage) getMatch(txn *badger.Txn, id uint64) ([]byte, error) {
+	item, err := txn.Get(matchKey(id))
+	if err == badger.ErrKeyNotFound {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	var data []byte
+	if item.UserMeta() == matchesMetaTypeRaw {
+		return item.ValueCopy(nil)
+	}
+	err = item.Value(func(val []byte) error {
+		data, err = s.decode(item.UserMeta(), val)
+		return err
+	})
+	return data, err
+}
+
+// Распаковывает тело матча, сохраненное с типом meta. Результат не ссылается на data.
+func (s *MatchesStorage) decode(meta byte, data []byte) ([]byte, error) {
+	_, data, _, err := splitMatchHash(meta, data)
+	if err != nil {
+		return nil, err
+	}
+	switch meta &^ matchesMetaHashed {
+	case matchesMetaTypeRaw:
+		return append([]byte(nil), data...), nil
+	case matchesMetaTypeFlate:
+		return inflate(data)
+	case matchesMetaTypeZlib:
+		if len(data) < zlibHeaderSize+zlibChecksumSize {
+			return nil, errors.New("zlib match value is too short")
+		}
+		return inflate(data[zlibHeaderSize : len(data)-zlibChecksumSize])
+	case matchesMetaTypeZstd:
+		codec := s.zstd.Load()
+		if codec == nil {
+			return nil, errNoDictionary
+		}
+		return codec.decoder.DecodeAll(data, nil)
+	}
+	return nil, fmt.Errorf("unknown match type %d", meta)
+}
+
+// Отделяет хэш от тела матча. hashed равен false, если матч сохранен без хэша.
+func splitMatchHash(meta byte, value []byte) (hash uint64, body []byte, hashed bool, err error) {
+	if meta&matchesMetaHashed == 0 {
+		return 0, value, false, nil
+	}
+	if len(value) < 8 {
+		return 0, nil, false, errors.New("match value is too short for a hash")
+	}
+	return byteOrder.Uint64(value), value[8:], true, nil
 }
 
 var deflaters = sync.Pool{New: func() interface{} {
@@ -90,8 +357,9 @@ var inflaters = sync.Pool{New: func() interface{} {
 	return flate.NewReader(nil)
 }}
 
-func deflate(data []byte) ([]byte, error) {
-	compressed := &bytes.Buffer{}
+// Дописывает сжатые data в конец dst
+func deflate(dst, data []byte) ([]byte, error) {
+	compressed := bytes.NewBuffer(dst)
 	writer := deflaters.Get().(*flate.Writer)
 	defer deflaters.Put(writer)
 	writer.Reset(compressed)
@@ -106,6 +374,24 @@ func deflate(data []byte) ([]byte, error) {
 	return compressed.Bytes(), nil
 }
 
+const (
+	zlibHeaderSize   = 2
+	zlibChecksumSize = 4
+)
+
+// Заголовок zlib: deflate с окном 32КБ и обычным уровнем сжатия
+var zlibHeader = []byte{0x78, 0x9c}
+
+// Дописывает сжатые data в конец dst в формате zlib
+func deflateZlib(dst, data []byte) ([]byte, error) {
+	dst = append(dst, zlibHeader...)
+	dst, err := deflate(dst, data)
+	if err != nil {
+		return nil, err
+	}
+	return byteOrder.AppendUint32(dst, adler32.Checksum(data)), nil
+}
+
 func inflate(data []byte) ([]byte, error) {
 	uncompressed := &bytes.Buffer{}
 	reader := inflaters.Get().(io.ReadCloser)
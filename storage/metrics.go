@@ -0,0 +1,108 @@
+package storage
+
+import (
+	"github.com/dgraph-io/badger/v4"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	txnConflicts = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "matchesdb_txn_conflicts_total",
+		Help: "Write transactions that failed with a conflict.",
+	})
+	txnRetries = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "matchesdb_txn_retries_total",
+		Help: "Write transactions retried after a conflict.",
+	})
+	txnConflictFailures = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "matchesdb_txn_conflict_failures_total",
+		Help: "Write transactions that still conflicted after all retries.",
+	})
+
+	matchSizes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "matchesdb_match_size_bytes",
+		Help:    "Sizes of saved match bodies: raw is the posted body, compressed is the stored size of bodies that were compressed.",
+		Buckets: prometheus.ExponentialBuckets(256, 4, 10),
+	}, []string{"format"})
+	userBucketSizes = promauto.NewHistogram(prometheus.HistogramOpts{
+		Name:    "matchesdb_user_bucket_size_bytes",
+		Help:    "Stored sizes of written user bucket values.",
+		Buckets: prometheus.ExponentialBuckets(16, 4, 8),
+	})
+
+	gcRuns = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "matchesdb_badger_gc_runs_total",
+		Help: "Value log GC runs.",
+	})
+	gcRewrites = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "matchesdb_badger_gc_rewrites_total",
+		Help: "Value log files rewritten by GC.",
+	})
+)
+
+// Размеры записанных значений. В метрики они попадают только после коммита, иначе повторы
+// транзакции при конфликте и откаченные записи учитывались бы несколько раз.
+//
+// Методы можно вызывать на nil, тогда размеры не учитываются.
+type pendingSizes struct {
+	observers []prometheus.Observer
+	values    []float64
+}
+
+func (p *pendingSizes) add(observer prometheus.Observer, size int) {
+	if p == nil || observer == nil {
+		return
+	}
+	p.observers = append(p.observers, observer)
+	p.values = append(p.values, float64(size))
+}
+
+// Учитывает размер сохраняемого тела матча. Сжатые тела учитываются дважды: до и после сжатия.
+func (p *pendingSizes) addMatch(size int, e *badger.Entry) {
+	p.add(matchSizes.WithLabelValues("raw"), size)
+	if e.UserMeta&^matchesMetaHashed != matchesMetaTypeRaw {
+		p.add(matchSizes.WithLabelValues("compressed"), len(e.Value))
+	}
+}
+
+// Забывает размеры, например перед повтором транзакции
+func (p *pendingSizes) reset() {
+	p.observers = p.observers[:0]
+	p.values = p.values[:0]
+}
+
+// Отправляет накопленные размеры в метрики, вызывается после успешного коммита
+func (p *pendingSizes) observe() {
+	for i, observer := range p.observers {
+		observer.Observe(p.values[i])
+	}
+	p.reset()
+}
+
+// Регистрирует метрики, которые badger считает сам. Вызывается один раз за процесс из OpenDatabase.
+func registerDatabaseMetrics(db *badger.DB) {
+	gauge := func(name, help, label, value string, fn func() float64) prometheus.Collector {
+		return prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Name:        name,
+			Help:        help,
+			ConstLabels: prometheus.Labels{label: value},
+		}, fn)
+	}
+	prometheus.MustRegister(
+		gauge("matchesdb_badger_size_bytes", "Size of badger files on disk.", "type", "lsm", func() float64 {
+			lsm, _ := db.Size()
+			return float64(lsm)
+		}),
+		gauge("matchesdb_badger_size_bytes", "Size of badger files on disk.", "type", "vlog", func() float64 {
+			_, vlog := db.Size()
+			return float64(vlog)
+		}),
+		gauge("matchesdb_badger_cache_hit_ratio", "Hit ratio of badger caches since start.", "cache", "block", func() float64 {
+			return db.BlockCacheMetrics().Ratio()
+		}),
+		gauge("matchesdb_badger_cache_hit_ratio", "Hit ratio of badger caches since start.", "cache", "index", func() float64 {
+			return db.IndexCacheMetrics().Ratio()
+		}),
+	)
+}
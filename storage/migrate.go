@@ -0,0 +1,249 @@
+package storage
+
+import (
+	"log"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+var schemaVersionKey = metaKey("schema")
+
+type migration struct {
+	name string
+	run  func(db *badger.DB, users *UserStorage) error
+}
+
+// Миграции выполняются по порядку, номер последней примененной хранится в schemaVersionKey.
+// Каждая миграция должна уметь продолжить работу, если процесс был убит на середине.
+var migrations = []migration{
+	{"prefixed keys", migratePrefixedKeys},
+	{"user stats", migrateUserStats},
+	{"bucket counts", migrateBucketCounts},
+}
+
+func Migrate(db *badger.DB, users *UserStorage) error {
+	var version uint32
+	err := db.View(func(txn *badger.Txn) error {
+		value, _, err := getWithValue(txn, schemaVersionKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		version = deserializeUint32(value)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	for i := int(version); i < len(migrations); i++ {
+		log.Printf("Running migration %d: %s", i+1, migrations[i].name)
+		if err := migrations[i].run(db, users); err != nil {
+			return err
+		}
+		err = db.Update(func(txn *badger.Txn) error {
+			return txn.Set(schemaVersionKey, serializeUint32(uint32(i+1)))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+var prefixedKeysCursorKey = metaKey("migrate-prefixed-cursor")
+
+const (
+	migrationBatchSize = 1000
+	// Ограничение на суммарный размер ключей и значений в пачке. Значения меньше ValueThreshold
+	// хранятся в LSM и учитываются в лимите размера транзакции badger, около 10МБ.
+	migrationBatchBytes = 4 << 20
+)
+
+// Вызывается после каждой записанной пачки. Тесты через него прерывают миграцию на середине.
+var afterMigrationBatch = func() error { return nil }
+
+// Переносит ключи без префикса под новые префиксы.
+//
+// 4-байтные ключи - индексы бакетов пользователей. 8-байтные ключи - либо тело матча,
+// либо бакет userid||bucket, их различаем по содержимому значения.
+//
+// Старый ключ удаляется в той же транзакции, в которой записывается новый, вместе с курсором,
+// поэтому после перезапуска миграция продолжится с места остановки.
+func migratePrefixedKeys(db *badger.DB, _ *UserStorage) error {
+	var cursor []byte
+	err := db.View(func(txn *badger.Txn) error {
+		value, _, err := getWithValue(txn, prefixedKeysCursorKey)
+		if err == badger.ErrKeyNotFound {
+			return nil
+		}
+		cursor = value
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	migrated := 0
+	for {
+		var entries []*badger.Entry
+		var oldKeys [][]byte
+		size := 0
+		err := db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.DefaultIteratorOptions)
+			defer it.Close()
+			for it.Seek(cursor); it.Valid() && len(entries) < migrationBatchSize && size < migrationBatchBytes; it.Next() {
+				item := it.Item()
+				key := item.KeyCopy(nil)
+				if len(key) != keyLength && len(key) != 8 {
+					continue
+				}
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				var newKey []byte
+				if len(key) == keyLength {
+					newKey = userBucketsKey(byteOrder.Uint32(key))
+				} else if isLegacyUserMatchesValue(key, value, item.UserMeta()) {
+					newKey = userMatchesKey(byteOrder.Uint32(key), byteOrder.Uint32(key[keyLength:]))
+				} else {
+					newKey = matchKey(byteOrder.Uint64(key))
+				}
+				e := badger.NewEntry(newKey, value).WithMeta(item.UserMeta())
+				e.ExpiresAt = item.ExpiresAt()
+				entries = append(entries, e)
+				oldKeys = append(oldKeys, key)
+				size += 2*len(key) + len(newKey) + len(value)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(entries) == 0 {
+			break
+		}
+
+		err = db.Update(func(txn *badger.Txn) error {
+			for i, e := range entries {
+				if err := txn.SetEntry(e); err != nil {
+					return err
+				}
+				if err := txn.Delete(oldKeys[i]); err != nil {
+					return err
+				}
+			}
+			return txn.Set(prefixedKeysCursorKey, oldKeys[len(oldKeys)-1])
+		})
+		if err != nil {
+			return err
+		}
+		cursor = oldKeys[len(oldKeys)-1]
+		migrated += len(entries)
+		log.Printf("Migrated %d keys", migrated)
+		if err = afterMigrationBatch(); err != nil {
+			return err
+		}
+	}
+
+	return db.Update(func(txn *badger.Txn) error {
+		return txn.Delete(prefixedKeysCursorKey)
+	})
+}
+
+// Бакет пользователя состоит из записей по matchSize байт, и все матчи в нем
+// относятся к бакету из второй половины ключа. Для тела матча это практически невозможно.
+func isLegacyUserMatchesValue(key, value []byte, meta byte) bool {
+	if meta != 1 || len(value) == 0 || len(value)%matchSize != 0 {
+		return false
+	}
+	bucket := byteOrder.Uint32(key[keyLength:])
+	for i := 0; i < len(value); i += matchSize {
+		if getBucketNumberFromId(byteOrder.Uint64(value[i:])) != bucket {
+			return false
+		}
+	}
+	return true
+}
+
+// Переводит индексы бакетов пользователей в версию 2, в которой рядом с номером бакета хранится
+// количество матчей в нем. Бакеты без ключа при этом убираются из индекса.
+//
+// Уже переведенные индексы пропускаются по версии, поэтому миграцию можно перезапустить.
+func migrateBucketCounts(db *badger.DB, users *UserStorage) error {
+	config := users.bucketsDescriptor
+	cursor := []byte{keyPrefixUserBuckets}
+	migrated := 0
+	for {
+		var entries []*badger.Entry
+		var last []byte
+		size := 0
+		err := db.View(func(txn *badger.Txn) error {
+			it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{keyPrefixUserBuckets}, PrefetchValues: true, PrefetchSize: 100})
+			defer it.Close()
+			for it.Seek(cursor); it.Valid() && len(entries) < migrationBatchSize && size < migrationBatchBytes; it.Next() {
+				item := it.Item()
+				last = item.KeyCopy(nil)
+				if item.UserMeta() == config.version {
+					continue
+				}
+				value, err := item.ValueCopy(nil)
+				if err != nil {
+					return err
+				}
+				userid := byteOrder.Uint32(last[prefixLength:])
+				index := make([]byte, 0, len(value)/bucketLength*bucketIndexSize)
+				for i := 0; i+bucketLength <= len(value); i += bucketLength {
+					bucket := byteOrder.Uint32(value[i:])
+					matches, err := users.userMatchesDescriptor.get(txn, userMatchesKey(userid, bucket))
+					if err == badger.ErrKeyNotFound {
+						continue
+					} else if err != nil {
+						return err
+					}
+					index = append(index, serializeBucketIndex(bucket, len(matches)/matchSize)...)
+				}
+				e := badger.NewEntry(last, index).WithMeta(config.version)
+				e.ExpiresAt = item.ExpiresAt()
+				entries = append(entries, e)
+				size += len(last) + len(index)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if last == nil {
+			break
+		}
+
+		err = db.Update(func(txn *badger.Txn) error {
+			for _, e := range entries {
+				var err error
+				if len(e.Value) == 0 {
+					err = txn.Delete(e.Key)
+				} else {
+					err = txn.SetEntry(e)
+				}
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		if len(entries) > 0 {
+			migrated += len(entries)
+			log.Printf("Migrated %d bucket indexes", migrated)
+		}
+		cursor = append(last, 0)
+		if err = afterMigrationBatch(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
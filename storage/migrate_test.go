@@ -0,0 +1,260 @@
+package storage
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"testing"
+	"time"
+
+	"github.com/VimeWorld/matches-db/types"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Пользователей больше, чем migrationBatchSize, чтобы каждая миграция писала несколько пачек
+const legacyUserCount = 1500
+
+var errMigrationInterrupted = errors.New("migration interrupted")
+
+type legacyValue struct {
+	value []byte
+	meta  byte
+}
+
+// База в формате до появления префиксов ключей и ожидаемое содержимое после migratePrefixedKeys
+type legacyDatabase struct {
+	db    *badger.DB
+	users *UserStorage
+	// Новые ключи и значения, которые должны получиться после переноса
+	expected map[string]legacyValue
+	// Матчи каждого пользователя
+	matches map[uint32][]*types.UserMatch
+}
+
+func openTestDatabase(t *testing.T) *badger.DB {
+	db, err := badger.Open(badger.DefaultOptions("").WithInMemory(true).WithLogger(nil))
+	if err != nil {
+		t.Fatalf("open: %s", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	return db
+}
+
+// Прерывает миграцию ошибкой после batches записанных пачек
+func interruptMigration(t *testing.T, batches int) {
+	written := 0
+	afterMigrationBatch = func() error {
+		written++
+		if written > batches {
+			return errMigrationInterrupted
+		}
+		return nil
+	}
+	t.Cleanup(resumeMigration)
+}
+
+func resumeMigration() {
+	afterMigrationBatch = func() error { return nil }
+}
+
+func newLegacyDatabase(t *testing.T) *legacyDatabase {
+	l := &legacyDatabase{
+		db:       openTestDatabase(t),
+		expected: make(map[string]legacyValue),
+		matches:  make(map[uint32][]*types.UserMatch),
+	}
+	l.users = &UserStorage{DB: l.db, TTL: 365 * 24 * time.Hour, Writes: &WriteLock{}}
+	l.users.Init()
+
+	rnd := rand.New(rand.NewSource(1))
+	now := (uint64(time.Now().UnixMilli()) - types.SnowflakeEpoch) << 22
+	put := func(txn *badger.Txn, oldKey, newKey, value []byte, meta byte) {
+		if err := txn.SetEntry(badger.NewEntry(oldKey, value).WithMeta(meta)); err != nil {
+			t.Fatalf("set: %s", err)
+		}
+		l.expected[string(newKey)] = legacyValue{value, meta}
+	}
+
+	err := l.db.Update(func(txn *badger.Txn) error {
+		for userid := uint32(1); userid <= legacyUserCount; userid++ {
+			id := now - uint64(userid)<<22
+			bucket := getBucketNumberFromId(id)
+			matches := []*types.UserMatch{
+				{Id: id, State: types.StateWin},
+				{Id: id + 1, State: byte(userid % 3)},
+			}
+			l.matches[userid] = matches
+			value, err := writeMatches(matches)
+			if err != nil {
+				return err
+			}
+			put(txn, userMatchesKey(userid, bucket)[prefixLength:], userMatchesKey(userid, bucket), value, 1)
+
+			index := serializeUint32(bucket)
+			if userid%10 == 0 {
+				// Бакет в индексе, ключа которого уже нет
+				index = append(serializeUint32(bucket-1), index...)
+			}
+			put(txn, serializeUint32(userid), userBucketsKey(userid), index, 1)
+
+			// Id матча, старшая половина которого совпадает с id пользователя, а младшая с номером
+			// другого его бакета, поэтому без префиксов ключ выглядит как бакет пользователя
+			collidingId := uint64(userid)<<32 | uint64(bucket+1)
+			if userid%2 == 0 {
+				put(txn, serializeUint64(collidingId), matchKey(collidingId), []byte(`{"id":1}`), matchesMetaTypeRaw)
+			} else {
+				// Сжатое тело, длина которого кратна размеру записи бакета
+				body := make([]byte, matchSize*2)
+				rnd.Read(body)
+				put(txn, serializeUint64(collidingId), matchKey(collidingId), body, matchesMetaTypeFlate)
+			}
+			put(txn, serializeUint64(id), matchKey(id), []byte(`{"players":[]}`), matchesMetaTypeRaw)
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("fill: %s", err)
+	}
+	return l
+}
+
+// Проверяет, что все ключи перенесены без изменений и старых ключей не осталось
+func (l *legacyDatabase) checkPrefixedKeys(t *testing.T) {
+	t.Helper()
+	err := l.db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.DefaultIteratorOptions)
+		defer it.Close()
+		found := 0
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.KeyCopy(nil)
+			if key[0] == keyPrefixMeta {
+				if bytes.Equal(key, prefixedKeysCursorKey) {
+					t.Errorf("cursor was not removed")
+				}
+				continue
+			}
+			expected, ok := l.expected[string(key)]
+			if !ok {
+				t.Errorf("unexpected key %x", key)
+				continue
+			}
+			found++
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			if !bytes.Equal(value, expected.value) || item.UserMeta() != expected.meta {
+				t.Errorf("key %x: got %x meta %d, want %x meta %d", key, value, item.UserMeta(), expected.value, expected.meta)
+			}
+		}
+		if found != len(l.expected) {
+			t.Errorf("found %d keys, want %d", found, len(l.expected))
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("view: %s", err)
+	}
+}
+
+func TestMigratePrefixedKeysResume(t *testing.T) {
+	l := newLegacyDatabase(t)
+
+	interruptMigration(t, 1)
+	if err := migratePrefixedKeys(l.db, l.users); err != errMigrationInterrupted {
+		t.Fatalf("expected interruption, got %v", err)
+	}
+	err := l.db.View(func(txn *badger.Txn) error {
+		_, err := txn.Get(prefixedKeysCursorKey)
+		return err
+	})
+	if err != nil {
+		t.Fatalf("cursor after interruption: %s", err)
+	}
+
+	resumeMigration()
+	if err := migratePrefixedKeys(l.db, l.users); err != nil {
+		t.Fatalf("resume: %s", err)
+	}
+	l.checkPrefixedKeys(t)
+}
+
+func TestMigrateUserStatsResume(t *testing.T) {
+	l := newLegacyDatabase(t)
+	if err := migratePrefixedKeys(l.db, l.users); err != nil {
+		t.Fatalf("prefixed keys: %s", err)
+	}
+
+	interruptMigration(t, 1)
+	if err := migrateUserStats(l.db, l.users); err != errMigrationInterrupted {
+		t.Fatalf("expected interruption, got %v", err)
+	}
+	resumeMigration()
+	if err := migrateUserStats(l.db, l.users); err != nil {
+		t.Fatalf("resume: %s", err)
+	}
+
+	for userid, matches := range l.matches {
+		expected := &types.UserStats{FirstMatch: matches[0].Id, LastMatch: matches[len(matches)-1].Id}
+		for _, m := range matches {
+			expected.Total++
+			switch m.State {
+			case types.StateWin:
+				expected.Wins++
+			case types.StateLoss:
+				expected.Losses++
+			case types.StateDraw:
+				expected.Draws++
+			}
+		}
+		stats, err := l.users.GetStats(userid)
+		if err != nil {
+			t.Fatalf("stats %d: %s", userid, err)
+		}
+		if *stats != *expected {
+			t.Fatalf("stats %d: got %+v, want %+v", userid, stats, expected)
+		}
+	}
+}
+
+func TestMigrateBucketCountsResume(t *testing.T) {
+	l := newLegacyDatabase(t)
+	if err := migratePrefixedKeys(l.db, l.users); err != nil {
+		t.Fatalf("prefixed keys: %s", err)
+	}
+
+	interruptMigration(t, 1)
+	if err := migrateBucketCounts(l.db, l.users); err != errMigrationInterrupted {
+		t.Fatalf("expected interruption, got %v", err)
+	}
+	resumeMigration()
+	if err := migrateBucketCounts(l.db, l.users); err != nil {
+		t.Fatalf("resume: %s", err)
+	}
+
+	err := l.db.View(func(txn *badger.Txn) error {
+		for userid, matches := range l.matches {
+			item, err := txn.Get(userBucketsKey(userid))
+			if err != nil {
+				return err
+			}
+			if item.UserMeta() != l.users.bucketsDescriptor.version {
+				t.Fatalf("user %d: index version %d", userid, item.UserMeta())
+			}
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			// Бакет без ключа убран, у оставшегося посчитаны матчи
+			expected := serializeBucketIndex(getBucketNumberFromId(matches[0].Id), len(matches))
+			if !bytes.Equal(value, expected) {
+				t.Fatalf("user %d: index %x, want %x", userid, value, expected)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("view: %s", err)
+	}
+}
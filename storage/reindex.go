@@ -0,0 +1,277 @@
+package storage
+
+import (
+	"context"
+	"encoding/json"
+	"log"
+	"math"
+	"time"
+
+	"github.com/VimeWorld/matches-db/types"
+	"github.com/dgraph-io/badger/v4"
+)
+
+const reindexBatchSize = 100
+
+type ReindexOptions struct {
+	// Максимальное количество матчей в секунду, 0 - без ограничений
+	Rate int
+	// Вызывается после каждой обработанной пачки матчей
+	Progress func(processed, total int64)
+}
+
+// Строит индексы пользователей заново по сохраненным телам матчей, не удаляя их заранее,
+// поэтому пока идет переиндексация, запросы к /user/* продолжают отдавать матчи.
+//
+// Сначала все матчи добавляются в бакеты участников. AddMatch идемпотентен, а каждая пачка
+// перечитывается и индексируется в одной транзакции, поэтому параллельно сохраненные или удаленные
+// матчи не испортят индекс. Затем из бакетов убираются записи о матчах, которых больше нет,
+// исправляются индексы бакетов, удаляются записи о матчах, в которых пользователь не участвовал,
+// и пересчитывается статистика пользователей.
+//
+// Каждая пачка пишется как запись в режиме обслуживания: если он включен, переиндексация
+// останавливается с ErrWriteLocked, и ее можно запустить заново после снятия блокировки.
+func (s *MatchesStorage) Reindex(ctx context.Context, opts ReindexOptions) error {
+	if s.Writes.Locked() {
+		return ErrWriteLocked
+	}
+	total, err := s.countMatches()
+	if err != nil {
+		return err
+	}
+
+	batchSize := reindexBatchSize
+	if opts.Rate > 0 && opts.Rate < batchSize {
+		batchSize = opts.Rate
+	}
+
+	var processed int64
+	cursor := matchKey(0)
+	start := time.Now()
+	for {
+		if err = ctx.Err(); err != nil {
+			return err
+		}
+
+		ids, err := s.nextMatchIds(cursor, batchSize)
+		if err != nil {
+			return err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		err = s.Writes.Run(func() error {
+			return s.Transaction(func(txn *MatchesTransaction) error {
+				return s.reindexMatches(txn, ids)
+			})
+		})
+		if err != nil {
+			return err
+		}
+
+		processed += int64(len(ids))
+		if opts.Progress != nil {
+			opts.Progress(processed, total)
+		}
+		last := ids[len(ids)-1]
+		if last == math.MaxUint64 {
+			break
+		}
+		cursor = matchKey(last + 1)
+
+		if opts.Rate > 0 {
+			expected := time.Duration(processed) * time.Second / time.Duration(opts.Rate)
+			if wait := expected - time.Since(start); wait > 0 {
+				select {
+				case <-time.After(wait):
+				case <-ctx.Done():
+					return ctx.Err()
+				}
+			}
+		}
+	}
+
+	report, err := s.Users.Verify(ctx, true, nil)
+	if err != nil {
+		return err
+	}
+	if report.Fixed > 0 {
+		log.Printf("Reindex: fixed %d stale buckets and indexes", report.Fixed)
+	}
+	pruned, err := s.pruneUserMatches(ctx)
+	if err != nil {
+		return err
+	}
+	if pruned > 0 {
+		log.Printf("Reindex: removed %d matches from users who did not play them", pruned)
+	}
+	// Статистика за все время не восстанавливается по телам матчей, поэтому ее не трогаем
+	if s.Users.AllTimeStats {
+		return nil
+	}
+	return s.Users.rebuildStats(ctx)
+}
+
+// Добавляет матчи ids в бакеты всех их участников
+func (s *MatchesStorage) reindexMatches(txn *MatchesTransaction, ids []uint64) error {
+	users := txn.Users()
+	// Статистика пересчитывается целиком после того, как бакеты будут исправлены
+	users.skipStats = true
+	for _, id := range ids {
+		data, err := txn.Get(id)
+		if err != nil {
+			return err
+		}
+		if data == nil {
+			continue
+		}
+		states, err := matchStates(data)
+		if err != nil {
+			log.Printf("Reindex: skip match %d: %s", id, err)
+			continue
+		}
+		for user, state := range states {
+			if err = users.AddMatch(user, id, state); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// Возвращает участников матча и их состояния
+func matchStates(data []byte) (map[uint32]byte, error) {
+	var match types.Match
+	if err := json.Unmarshal(data, &match); err != nil {
+		return nil, err
+	}
+	return match.GetStates(), nil
+}
+
+type userMatch struct {
+	userid uint32
+	id     uint64
+}
+
+// Удаляет из бакетов пользователей записи о матчах, в теле которых этого пользователя нет.
+// Статистика при этом обновляется, поэтому вместе с записью уходит и посчитанный по ней матч.
+//
+// Записи о матчах без тела и с телом, которое не удалось разобрать, не трогаются,
+// их разбирает Verify. Возвращает количество удаленных записей.
+func (s *MatchesStorage) pruneUserMatches(ctx context.Context) (int, error) {
+	var stale []userMatch
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{keyPrefixUserMatches}, PrefetchValues: true, PrefetchSize: 100})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := it.Item()
+			userid := byteOrder.Uint32(item.Key()[prefixLength:])
+			stored, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			value, _, err := s.Users.userMatchesDescriptor.read(stored, item.UserMeta())
+			if err != nil {
+				continue
+			}
+			for i := 0; i+matchSize <= len(value); i += matchSize {
+				id := byteOrder.Uint64(value[i:])
+				data, err := s.getMatch(txn, id)
+				if err != nil {
+					return err
+				}
+				if data == nil {
+					continue
+				}
+				states, err := matchStates(data)
+				if err != nil {
+					continue
+				}
+				if _, ok := states[userid]; !ok {
+					stale = append(stale, userMatch{userid, id})
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	pruned := 0
+	for len(stale) > 0 {
+		if err = ctx.Err(); err != nil {
+			return pruned, err
+		}
+		batch := stale
+		if len(batch) > reindexBatchSize {
+			batch = batch[:reindexBatchSize]
+		}
+		stale = stale[len(batch):]
+
+		batchPruned := 0
+		err = s.Writes.Run(func() error {
+			return s.Transaction(func(txn *MatchesTransaction) error {
+				batchPruned = 0
+				users := txn.Users()
+				for _, m := range batch {
+					// Матч мог быть перезаписан, пока шла проверка
+					data, err := txn.Get(m.id)
+					if err != nil {
+						return err
+					}
+					if data == nil {
+						continue
+					}
+					states, err := matchStates(data)
+					if err != nil {
+						continue
+					}
+					if _, ok := states[m.userid]; ok {
+						continue
+					}
+					if err = users.RemoveMatch(m.userid, m.id); err != nil {
+						return err
+					}
+					batchPruned++
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return pruned, err
+		}
+		pruned += batchPruned
+	}
+	return pruned, nil
+}
+
+func (s *MatchesStorage) nextMatchIds(from []byte, limit int) ([]uint64, error) {
+	var ids []uint64
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{keyPrefixMatch}})
+		defer it.Close()
+		for it.Seek(from); it.Valid() && len(ids) < limit; it.Next() {
+			ids = append(ids, byteOrder.Uint64(it.Item().Key()[prefixLength:]))
+		}
+		return nil
+	})
+	return ids, err
+}
+
+func (s *MatchesStorage) countMatches() (int64, error) {
+	var count int64
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{keyPrefixMatch}})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			count++
+		}
+		return nil
+	})
+	return count, err
+}
@@ -0,0 +1,148 @@
+package storage
+
+import (
+	"bytes"
+	"log"
+	"sort"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Сортирует бакеты пользователей и их индексы, которые были записаны не по порядку
+// до того, как AddMatch начал вставлять значения на свое место, и убирает из них дубликаты.
+//
+// Возвращает количество исправленных ключей. Если включен режим обслуживания, то останавливается с ErrWriteLocked.
+func (s *UserStorage) SortBuckets() (int, error) {
+	if s.Writes.Locked() {
+		return 0, ErrWriteLocked
+	}
+	fixed := 0
+	for _, prefix := range []byte{keyPrefixUserBuckets, keyPrefixUserMatches} {
+		config := s.userMatchesDescriptor
+		idSize := 8
+		if prefix == keyPrefixUserBuckets {
+			config = s.bucketsDescriptor
+			idSize = bucketLength
+		}
+		n, err := s.sortValues(prefix, idSize, config)
+		fixed += n
+		if err != nil {
+			return fixed, err
+		}
+	}
+	return fixed, nil
+}
+
+func (s *UserStorage) sortValues(prefix byte, idSize int, config *valueDescriptor) (int, error) {
+	var unsorted [][]byte
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{prefix}, PrefetchValues: true, PrefetchSize: 100})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			err := item.Value(func(val []byte) error {
+				value, _, err := config.read(val, item.UserMeta())
+				if err != nil {
+					return err
+				}
+				if !isSortedChunks(value, idSize, config.size) {
+					unsorted = append(unsorted, item.KeyCopy(nil))
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	fixed := 0
+	for len(unsorted) > 0 {
+		batch := unsorted
+		if len(batch) > migrationBatchSize {
+			batch = batch[:migrationBatchSize]
+		}
+		unsorted = unsorted[len(batch):]
+
+		batchFixed := 0
+		err = s.Writes.Run(func() error {
+			return updateWithRetry(s.DB, func(txn *badger.Txn) error {
+				batchFixed = 0
+				for _, key := range batch {
+					item, err := txn.Get(key)
+					if err == badger.ErrKeyNotFound {
+						continue
+					} else if err != nil {
+						return err
+					}
+					stored, err := item.ValueCopy(nil)
+					if err != nil {
+						return err
+					}
+					value, _, err := config.read(stored, item.UserMeta())
+					if err != nil {
+						return err
+					}
+					sorted := sortChunks(value, idSize, config.size)
+					if bytes.Equal(sorted, value) {
+						continue
+					}
+					e := config.entry(key, sorted)
+					e.ExpiresAt = item.ExpiresAt()
+					if err = txn.SetEntry(e); err != nil {
+						return err
+					}
+					// Дубликаты убраны, поэтому количество матчей в индексе тоже меняется
+					if prefix == keyPrefixUserMatches {
+						users := &UsersTransaction{s: s, txn: txn}
+						userid := byteOrder.Uint32(key[prefixLength:])
+						bucket := byteOrder.Uint32(key[prefixLength+keyLength:])
+						if err = users.setBucketCount(userid, bucket, len(sorted)/config.size); err != nil {
+							return err
+						}
+					}
+					batchFixed++
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return fixed, err
+		}
+		fixed += batchFixed
+		log.Printf("Sorted %d values", fixed)
+	}
+	return fixed, nil
+}
+
+func isSortedChunks(value []byte, idSize, size int) bool {
+	for i := size; i+size <= len(value); i += size {
+		if bytes.Compare(value[i-size:i-size+idSize], value[i:i+idSize]) >= 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// Сортирует куски размера size по первым idSize байтам. Из кусков с одинаковым id остается последний записанный.
+func sortChunks(value []byte, idSize, size int) []byte {
+	chunks := make([][]byte, len(value)/size)
+	for i := range chunks {
+		chunks[i] = value[i*size : (i+1)*size]
+	}
+	sort.SliceStable(chunks, func(i, j int) bool {
+		return bytes.Compare(chunks[i][:idSize], chunks[j][:idSize]) < 0
+	})
+	result := make([]byte, 0, len(value))
+	for i, chunk := range chunks {
+		if i+1 < len(chunks) && bytes.Equal(chunk[:idSize], chunks[i+1][:idSize]) {
+			continue
+		}
+		result = append(result, chunk...)
+	}
+	return result
+}
@@ -116,23 +116,99 @@ func (b *byteBuf) Remaining() int {
 	return len(b.buf) - b.readerIndex
 }
 
+// Читает матчи из значения бакета пользователя версии version
 func readMatches(version byte, buf []byte) ([]*types.UserMatch, error) {
-	if version == 1 {
-		buffer := newByteBuf(buf, false)
-		matches := make([]*types.UserMatch, len(buf)/matchSize)
-		index := 0
-		for buffer.Remaining() > 0 {
-			m := &types.UserMatch{}
-			m.Id = buffer.ReadUint64()
-			m.State = buffer.ReadByte()
-			matches[index] = m
-			index++
+	switch version {
+	case 1:
+		return parseMatches(buf), nil
+	case 2:
+		decoded, err := decodeMatchesV2(buf)
+		if err != nil {
+			return nil, err
 		}
-		return matches, nil
+		return parseMatches(decoded), nil
 	}
 	return nil, errors.New(fmt.Sprint("unsupported version", version))
 }
 
+// Разбирает матчи из развернутого представления: записи по matchSize байт
+func parseMatches(buf []byte) []*types.UserMatch {
+	buffer := newByteBuf(buf, false)
+	matches := make([]*types.UserMatch, len(buf)/matchSize)
+	for i := range matches {
+		m := &types.UserMatch{}
+		m.Id = buffer.ReadUint64()
+		m.State = buffer.ReadByte()
+		matches[i] = m
+	}
+	return matches
+}
+
+// Версия 2 значения бакета пользователя:
+//
+//	uvarint количество матчей, id первого матча в 8 байтах,
+//	uvarint разницы id с предыдущим для остальных матчей,
+//	состояния матчей по 2 бита, начиная со старших битов байта.
+//
+// Матчи в бакете отсортированы и относятся к одним 10 дням, поэтому разницы занимают меньше 8 байт.
+// Разница считается по модулю 2^64, так что закодировать можно и неотсортированный бакет.
+func encodeMatchesV2(value []byte) []byte {
+	count := len(value) / matchSize
+	if count == 0 {
+		return nil
+	}
+	buf := make([]byte, 0, binary.MaxVarintLen32+8+count*7+(count+3)/4)
+	buf = binary.AppendUvarint(buf, uint64(count))
+	prev := byteOrder.Uint64(value)
+	buf = byteOrder.AppendUint64(buf, prev)
+	for i := 1; i < count; i++ {
+		id := byteOrder.Uint64(value[i*matchSize:])
+		buf = binary.AppendUvarint(buf, id-prev)
+		prev = id
+	}
+	states := len(buf)
+	buf = append(buf, make([]byte, (count+3)/4)...)
+	for i := 0; i < count; i++ {
+		buf[states+i/4] |= (value[i*matchSize+8] & 3) << (6 - 2*(i%4))
+	}
+	return buf
+}
+
+var errMalformedMatches = errors.New("malformed user matches value")
+
+// Разворачивает значение версии 2 в записи по matchSize байт
+func decodeMatchesV2(buf []byte) ([]byte, error) {
+	if len(buf) == 0 {
+		return nil, nil
+	}
+	count, n := binary.Uvarint(buf)
+	if n <= 0 || count == 0 || count > uint64(len(buf)) || len(buf) < n+8 {
+		return nil, errMalformedMatches
+	}
+	buf = buf[n:]
+	value := make([]byte, int(count)*matchSize)
+	id := byteOrder.Uint64(buf)
+	buf = buf[8:]
+	for i := 0; i < int(count); i++ {
+		if i > 0 {
+			delta, n := binary.Uvarint(buf)
+			if n <= 0 {
+				return nil, errMalformedMatches
+			}
+			buf = buf[n:]
+			id += delta
+		}
+		byteOrder.PutUint64(value[i*matchSize:], id)
+	}
+	if len(buf) != (int(count)+3)/4 {
+		return nil, errMalformedMatches
+	}
+	for i := 0; i < int(count); i++ {
+		value[i*matchSize+8] = (buf[i/4] >> (6 - 2*(i%4))) & 3
+	}
+	return value, nil
+}
+
 func readMatch(version byte, reader *byteBuf, match *types.UserMatch) error {
 	if version == 1 {
 		match.Id = reader.ReadUint64()
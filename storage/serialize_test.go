@@ -0,0 +1,175 @@
+package storage
+
+import (
+	"bytes"
+	"math"
+	"math/rand"
+	"sort"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/VimeWorld/matches-db/types"
+)
+
+// Синтетические бакеты: count бакетов по perBucket матчей, разбросанных по 10 дням
+func benchmarkBuckets(count, perBucket int) [][]byte {
+	rnd := rand.New(rand.NewSource(1))
+	values := make([][]byte, count)
+	bucketSpan := uint64(10*24*time.Hour/time.Millisecond) << 22
+	start := (uint64(time.Now().UnixMilli()) - types.SnowflakeEpoch) << 22
+	for i := range values {
+		ids := make([]uint64, perBucket)
+		for j := range ids {
+			ids[j] = start + uint64(rnd.Int63n(int64(bucketSpan)))
+		}
+		sort.Slice(ids, func(a, b int) bool { return ids[a] < ids[b] })
+		matches := make([]*types.UserMatch, perBucket)
+		for j, id := range ids {
+			matches[j] = &types.UserMatch{Id: id, State: byte(rnd.Intn(3))}
+		}
+		values[i], _ = writeMatches(matches)
+	}
+	return values
+}
+
+const (
+	benchmarkBucketCount = 1000
+	benchmarkPerBucket   = 50
+)
+
+// Отчитывается о размере значений в байтах на матч и времени на матч
+func reportPerMatch(b *testing.B, values [][]byte) {
+	size := 0
+	for _, value := range values {
+		size += len(value)
+	}
+	matches := float64(benchmarkBucketCount * benchmarkPerBucket)
+	b.ReportMetric(float64(size)/matches, "bytes/match")
+	b.ReportMetric(float64(b.Elapsed().Nanoseconds())/float64(b.N)/matches, "ns/match")
+}
+
+func BenchmarkEncodeMatchesV1(b *testing.B) {
+	values := benchmarkBuckets(benchmarkBucketCount, benchmarkPerBucket)
+	matches := make([][]*types.UserMatch, len(values))
+	for i, value := range values {
+		matches[i] = parseMatches(value)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, m := range matches {
+			_, _ = writeMatches(m)
+		}
+	}
+	reportPerMatch(b, values)
+}
+
+func BenchmarkEncodeMatchesV2(b *testing.B) {
+	values := benchmarkBuckets(benchmarkBucketCount, benchmarkPerBucket)
+	encoded := make([][]byte, len(values))
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for i, value := range values {
+			encoded[i] = encodeMatchesV2(value)
+		}
+	}
+	reportPerMatch(b, encoded)
+}
+
+func BenchmarkDecodeMatchesV1(b *testing.B) {
+	values := benchmarkBuckets(benchmarkBucketCount, benchmarkPerBucket)
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, value := range values {
+			_, _ = readMatches(1, value)
+		}
+	}
+	reportPerMatch(b, values)
+}
+
+func BenchmarkDecodeMatchesV2(b *testing.B) {
+	values := benchmarkBuckets(benchmarkBucketCount, benchmarkPerBucket)
+	for i, value := range values {
+		values[i] = encodeMatchesV2(value)
+	}
+	b.ResetTimer()
+	for n := 0; n < b.N; n++ {
+		for _, value := range values {
+			_, _ = readMatches(2, value)
+		}
+	}
+	reportPerMatch(b, values)
+}
+
+func matchesValue(matches ...types.UserMatch) []byte {
+	value := make([]byte, 0, len(matches)*matchSize)
+	for _, m := range matches {
+		value = append(value, serializeMatch(m.Id, m.State)...)
+	}
+	return value
+}
+
+func TestMatchesV2RoundTrip(t *testing.T) {
+	tests := map[string][]byte{
+		"empty":  nil,
+		"single": matchesValue(types.UserMatch{Id: 1 << 40, State: types.StateWin}),
+		"sorted": matchesValue(
+			types.UserMatch{Id: 1 << 40, State: types.StateLoss},
+			types.UserMatch{Id: 1<<40 + 1, State: types.StateWin},
+			types.UserMatch{Id: 1<<40 + 1<<30, State: types.StateDraw},
+			types.UserMatch{Id: 1<<41 + 5, State: types.StateWin},
+			types.UserMatch{Id: 1<<41 + 6, State: types.StateLoss},
+		),
+		"unsorted": matchesValue(
+			types.UserMatch{Id: 1<<41 + 5, State: types.StateWin},
+			types.UserMatch{Id: 1 << 40, State: types.StateDraw},
+			types.UserMatch{Id: math.MaxUint64, State: types.StateLoss},
+			types.UserMatch{Id: 0, State: types.StateWin},
+		),
+		"duplicates": matchesValue(
+			types.UserMatch{Id: 1 << 40, State: types.StateWin},
+			types.UserMatch{Id: 1 << 40, State: types.StateDraw},
+		),
+	}
+	for i, value := range benchmarkBuckets(10, 37) {
+		tests["synthetic "+strconv.Itoa(i)] = value
+	}
+
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			decoded, err := decodeMatchesV2(encodeMatchesV2(value))
+			if err != nil {
+				t.Fatalf("decode: %s", err)
+			}
+			if !bytes.Equal(decoded, value) {
+				t.Fatalf("round trip mismatch:\n got %x\nwant %x", decoded, value)
+			}
+		})
+	}
+}
+
+func TestDecodeMatchesV2Malformed(t *testing.T) {
+	valid := encodeMatchesV2(matchesValue(
+		types.UserMatch{Id: 1 << 40, State: types.StateWin},
+		types.UserMatch{Id: 1<<40 + 300, State: types.StateDraw},
+		types.UserMatch{Id: 1<<40 + 70000, State: types.StateLoss},
+	))
+
+	tests := map[string][]byte{
+		"zero count":       {0},
+		"bad count varint": {0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff},
+		"count too large":  append([]byte{0xff, 0x01}, valid[1:]...),
+		"no first id":      valid[:5],
+		"truncated deltas": valid[:10],
+		"no states":        valid[:len(valid)-1],
+		"extra states":     append(append([]byte(nil), valid...), 0),
+		"bad delta varint": append(append([]byte(nil), valid[:9]...), 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff, 0xff),
+	}
+	for name, value := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := decodeMatchesV2(value); err != errMalformedMatches {
+				t.Fatalf("expected errMalformedMatches, got %v", err)
+			}
+		})
+	}
+}
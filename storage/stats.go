@@ -0,0 +1,388 @@
+package storage
+
+import (
+	"bytes"
+	"context"
+	"math"
+
+	"github.com/VimeWorld/matches-db/types"
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Статистика пользователя хранится по бакетам: bucket, total, wins, losses, draws, first, last.
+// Так можно посчитать статистику только по матчам, которые еще хранятся, отбросив старые бакеты.
+const statsSize = 4*5 + 8*2
+
+// Состояние, которого нет: матч добавлен или удален
+const noState = -1
+
+type bucketStats struct {
+	bucket uint32
+	total  uint32
+	wins   uint32
+	losses uint32
+	draws  uint32
+	first  uint64
+	last   uint64
+}
+
+func readBucketStats(buf []byte) *bucketStats {
+	reader := newByteBuf(buf, false)
+	return &bucketStats{
+		bucket: reader.ReadUint32(),
+		total:  reader.ReadUint32(),
+		wins:   reader.ReadUint32(),
+		losses: reader.ReadUint32(),
+		draws:  reader.ReadUint32(),
+		first:  reader.ReadUint64(),
+		last:   reader.ReadUint64(),
+	}
+}
+
+func writeBucketStats(buf []byte, stats *bucketStats) {
+	writer := newByteBuf(buf, false)
+	writer.WriteUint32(stats.bucket)
+	writer.WriteUint32(stats.total)
+	writer.WriteUint32(stats.wins)
+	writer.WriteUint32(stats.losses)
+	writer.WriteUint32(stats.draws)
+	writer.WriteUint64(stats.first)
+	writer.WriteUint64(stats.last)
+}
+
+func (b *bucketStats) counter(state int) *uint32 {
+	switch byte(state) {
+	case types.StateWin:
+		return &b.wins
+	case types.StateLoss:
+		return &b.losses
+	case types.StateDraw:
+		return &b.draws
+	}
+	return nil
+}
+
+// Применяет к статистике пользователя изменение состояния матча id в бакете bucket.
+// oldState равен noState, если матч добавлен, а newState равен noState, если матч удален.
+//
+// Если удален первый или последний матч бакета, то они пересчитываются по bucketMatches,
+// который должен вернуть значение бакета уже после удаления.
+func applyStats(value []byte, bucket uint32, id uint64, oldState, newState int, bucketMatches func() ([]byte, error)) ([]byte, error) {
+	count := len(value) / statsSize
+	idx := 0
+	for idx < count && byteOrder.Uint32(value[idx*statsSize:]) < bucket {
+		idx++
+	}
+
+	var stats *bucketStats
+	if idx < count && byteOrder.Uint32(value[idx*statsSize:]) == bucket {
+		stats = readBucketStats(value[idx*statsSize : (idx+1)*statsSize])
+	} else {
+		if oldState != noState {
+			// Матча нет в статистике, например если она была собрана позже
+			oldState = noState
+			if newState == noState {
+				return value, nil
+			}
+		}
+		stats = &bucketStats{bucket: bucket, first: id, last: id}
+		newValue := make([]byte, len(value)+statsSize)
+		copy(newValue, value[:idx*statsSize])
+		copy(newValue[(idx+1)*statsSize:], value[idx*statsSize:])
+		value = newValue
+	}
+
+	if oldState != noState {
+		if c := stats.counter(oldState); c != nil && *c > 0 {
+			*c--
+		}
+	} else {
+		stats.total++
+	}
+	if newState != noState {
+		if c := stats.counter(newState); c != nil {
+			*c++
+		}
+		if id < stats.first {
+			stats.first = id
+		}
+		if id > stats.last {
+			stats.last = id
+		}
+	} else if stats.total > 0 {
+		stats.total--
+	}
+
+	if stats.total == 0 {
+		return append(value[:idx*statsSize], value[(idx+1)*statsSize:]...), nil
+	}
+	if newState == noState && (id == stats.first || id == stats.last) {
+		matches, err := bucketMatches()
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) >= matchSize {
+			stats.first = byteOrder.Uint64(matches)
+			stats.last = byteOrder.Uint64(matches[len(matches)-matchSize:])
+		}
+	}
+	writeBucketStats(value[idx*statsSize:(idx+1)*statsSize], stats)
+	return value, nil
+}
+
+// Убирает статистику по бакетам, матчи из которых уже не хранятся.
+func (s *UserStorage) filterOldStats(value []byte) []byte {
+	if s.AllTimeStats {
+		return value
+	}
+	minBucketNumber := s.oldestBucketNum()
+	for i := 0; i < len(value)/statsSize; i++ {
+		if byteOrder.Uint32(value[i*statsSize:]) >= minBucketNumber {
+			return value[i*statsSize:]
+		}
+	}
+	return value[:0]
+}
+
+func (t *UsersTransaction) updateStats(userid uint32, bucket uint32, id uint64, oldState, newState int) error {
+	if t.skipStats || oldState == newState {
+		return nil
+	}
+	key := userStatsKey(userid)
+	config := t.s.statsDescriptor
+	stored, _, err := getWithValue(t.txn, key)
+	if err != nil && err != badger.ErrKeyNotFound {
+		return err
+	}
+	stored, err = applyStats(stored, bucket, id, oldState, newState, func() ([]byte, error) {
+		value, err := t.s.userMatchesDescriptor.get(t.txn, userMatchesKey(userid, bucket))
+		if err == badger.ErrKeyNotFound {
+			return nil, nil
+		}
+		return value, err
+	})
+	if err != nil {
+		return err
+	}
+	stored = t.s.filterOldStats(stored)
+	if len(stored) == 0 {
+		return t.txn.Delete(key)
+	}
+	return t.txn.SetEntry(config.entry(key, stored))
+}
+
+func (t *UsersTransaction) GetStats(userid uint32) (*types.UserStats, error) {
+	stats := &types.UserStats{}
+	value, _, err := getWithValue(t.txn, userStatsKey(userid))
+	if err == badger.ErrKeyNotFound {
+		return stats, nil
+	} else if err != nil {
+		return nil, err
+	}
+	value = t.s.filterOldStats(value)
+	for i := 0; i+statsSize <= len(value); i += statsSize {
+		b := readBucketStats(value[i : i+statsSize])
+		stats.Total += int(b.total)
+		stats.Wins += int(b.wins)
+		stats.Losses += int(b.losses)
+		stats.Draws += int(b.draws)
+		if stats.FirstMatch == 0 || b.first < stats.FirstMatch {
+			stats.FirstMatch = b.first
+		}
+		if b.last > stats.LastMatch {
+			stats.LastMatch = b.last
+		}
+	}
+	return stats, nil
+}
+
+func (s *UserStorage) GetStats(id uint32) (*types.UserStats, error) {
+	var stats *types.UserStats
+	err := s.Transaction(func(txn *UsersTransaction) error {
+		st, err := txn.GetStats(id)
+		stats = st
+		return err
+	}, false)
+	return stats, err
+}
+
+// Собирает статистику пользователей по уже сохраненным бакетам.
+// Статистика пользователя перезаписывается целиком, поэтому миграцию можно безопасно перезапустить.
+func migrateUserStats(db *badger.DB, users *UserStorage) error {
+	var userid uint32
+	var stats []byte
+	var pending []*badger.Entry
+	pendingSize := 0
+	flush := func() error {
+		err := db.Update(func(txn *badger.Txn) error {
+			for _, e := range pending {
+				if err := txn.SetEntry(e); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		pending = pending[:0]
+		pendingSize = 0
+		if err != nil {
+			return err
+		}
+		return afterMigrationBatch()
+	}
+	finishUser := func() error {
+		stats = users.filterOldStats(stats)
+		if len(stats) > 0 {
+			e := users.statsDescriptor.entry(userStatsKey(userid), stats)
+			pending = append(pending, e)
+			pendingSize += len(e.Key) + len(e.Value)
+		}
+		stats = nil
+		if len(pending) >= migrationBatchSize || pendingSize >= migrationBatchBytes {
+			return flush()
+		}
+		return nil
+	}
+
+	err := db.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{keyPrefixUserMatches}, PrefetchValues: true, PrefetchSize: 100})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			item := it.Item()
+			key := item.Key()
+			user := byteOrder.Uint32(key[prefixLength:])
+			if user != userid && stats != nil {
+				if err := finishUser(); err != nil {
+					return err
+				}
+			}
+			userid = user
+			bucket := byteOrder.Uint32(key[prefixLength+keyLength:])
+			err := item.Value(func(val []byte) error {
+				matches, err := readMatches(item.UserMeta(), val)
+				if err != nil {
+					return err
+				}
+				for _, m := range matches {
+					stats, err = applyStats(stats, bucket, m.Id, noState, int(m.State), nil)
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if stats != nil {
+			return finishUser()
+		}
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return flush()
+}
+
+// Пересчитывает статистику каждого пользователя по его бакетам. Статистика пользователей, у которых
+// не осталось бакетов, удаляется. Каждый пользователь обрабатывается в отдельной транзакции.
+func (s *UserStorage) rebuildStats(ctx context.Context) error {
+	for _, prefix := range []byte{keyPrefixUserMatches, keyPrefixUserStats} {
+		var from uint32
+		for {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			users, err := s.nextUserIds(prefix, from, reindexBatchSize)
+			if err != nil {
+				return err
+			}
+			if len(users) == 0 {
+				break
+			}
+			for _, userid := range users {
+				err = s.Writes.Run(func() error {
+					return s.Transaction(func(txn *UsersTransaction) error {
+						return txn.rebuildStats(userid)
+					}, true)
+				})
+				if err != nil {
+					return err
+				}
+			}
+			last := users[len(users)-1]
+			if last == math.MaxUint32 {
+				break
+			}
+			from = last + 1
+		}
+	}
+	return nil
+}
+
+func (t *UsersTransaction) rebuildStats(userid uint32) error {
+	var stats []byte
+	prefix := userMatchesKey(userid, 0)[:prefixLength+keyLength]
+	it := t.txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true, PrefetchSize: 100})
+	defer it.Close()
+	for it.Rewind(); it.Valid(); it.Next() {
+		item := it.Item()
+		bucket := byteOrder.Uint32(item.Key()[prefixLength+keyLength:])
+		err := item.Value(func(val []byte) error {
+			matches, err := readMatches(item.UserMeta(), val)
+			if err != nil {
+				return err
+			}
+			for _, m := range matches {
+				if stats, err = applyStats(stats, bucket, m.Id, noState, int(m.State), nil); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	stats = t.s.filterOldStats(stats)
+
+	key := userStatsKey(userid)
+	stored, _, err := getWithValue(t.txn, key)
+	if err == badger.ErrKeyNotFound {
+		if len(stats) == 0 {
+			return nil
+		}
+	} else if err != nil {
+		return err
+	} else if bytes.Equal(t.s.filterOldStats(stored), stats) {
+		return nil
+	}
+	if len(stats) == 0 {
+		return t.txn.Delete(key)
+	}
+	return t.txn.SetEntry(t.s.statsDescriptor.entry(key, stats))
+}
+
+// Возвращает до limit разных id пользователей начиная с from, у которых есть ключи с префиксом prefix
+func (s *UserStorage) nextUserIds(prefix byte, from uint32, limit int) ([]uint32, error) {
+	var users []uint32
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{prefix}})
+		defer it.Close()
+		seek := make([]byte, prefixLength+keyLength)
+		seek[0] = prefix
+		byteOrder.PutUint32(seek[prefixLength:], from)
+		for it.Seek(seek); it.Valid() && len(users) < limit; it.Seek(seek) {
+			userid := byteOrder.Uint32(it.Item().Key()[prefixLength:])
+			users = append(users, userid)
+			if userid == math.MaxUint32 {
+				break
+			}
+			// Пропускаем остальные бакеты этого пользователя
+			byteOrder.PutUint32(seek[prefixLength:], userid+1)
+		}
+		return nil
+	})
+	return users, err
+}
@@ -1,6 +1,7 @@
 package storage
 
 import (
+	"fmt"
 	"sort"
 	"time"
 
@@ -11,65 +12,97 @@ import (
 const (
 	keyLength    = 4
 	bucketLength = 4
+	// Запись индекса бакетов: номер бакета и количество матчей в нем
+	bucketIndexSize = bucketLength + 4
 )
 
 type UserStorage struct {
 	DB  *badger.DB
 	TTL time.Duration
+	// Хранить статистику пользователей за все время, а не только по матчам, которые еще не истекли
+	AllTimeStats bool
+	// Режим обслуживания, общий с MatchesStorage
+	Writes *WriteLock
 
 	userMatchesDescriptor *valueDescriptor
 	bucketsDescriptor     *valueDescriptor
+	statsDescriptor       *valueDescriptor
 }
 
 func (s *UserStorage) Init() {
 	s.userMatchesDescriptor = &valueDescriptor{
-		version:  1,
+		version:  2,
 		size:     matchSize,
 		migrator: migrateMatches,
+		encode:   encodeMatchesV2,
+		decode:   decodeMatchesV2,
 		ttl:      s.TTL,
+		sizes:    userBucketSizes,
 	}
 	s.bucketsDescriptor = &valueDescriptor{
+		version:  2,
+		size:     bucketIndexSize,
+		migrator: migrateBucketIndex,
+		ttl:      s.TTL + 10*24*time.Hour,
+	}
+	s.statsDescriptor = &valueDescriptor{
 		version: 1,
-		size:    bucketLength,
-		ttl:     s.TTL + 10*24*time.Hour,
+		size:    statsSize,
+		ttl:     s.bucketsDescriptor.ttl,
+	}
+	if s.AllTimeStats {
+		s.statsDescriptor.ttl = 0
 	}
 }
 
-func (s *UserStorage) GetLastUserMatches(id uint32, offset, count int) ([]*types.UserMatch, error) {
+func (s *UserStorage) GetLastUserMatches(id uint32, offset, count int, r MatchFilter) ([]*types.UserMatch, error) {
 	var matches []*types.UserMatch
 	err := s.Transaction(func(txn *UsersTransaction) error {
-		m, err := txn.GetLastUserMatches(id, offset, count)
+		m, err := txn.GetLastUserMatches(id, offset, count, r)
 		matches = m
 		return err
 	}, false)
 	return matches, err
 }
 
-func (s *UserStorage) GetUserMatchesAfter(id uint32, begin uint64, count int) ([]*types.UserMatch, error) {
+func (s *UserStorage) GetUserMatchesAfter(id uint32, begin uint64, count int, r MatchFilter) ([]*types.UserMatch, error) {
 	var matches []*types.UserMatch
 	err := s.Transaction(func(txn *UsersTransaction) error {
-		m, err := txn.GetUserMatchesAfter(id, begin, count)
+		m, err := txn.GetUserMatchesAfter(id, begin, count, r)
 		matches = m
 		return err
 	}, false)
 	return matches, err
 }
 
-func (s *UserStorage) GetUserMatchesBefore(id uint32, begin uint64, count int) ([]*types.UserMatch, error) {
+func (s *UserStorage) GetUserMatchesBefore(id uint32, begin uint64, count int, r MatchFilter) ([]*types.UserMatch, error) {
 	var matches []*types.UserMatch
 	err := s.Transaction(func(txn *UsersTransaction) error {
-		m, err := txn.GetUserMatchesBefore(id, begin, count)
+		m, err := txn.GetUserMatchesBefore(id, begin, count, r)
 		matches = m
 		return err
 	}, false)
 	return matches, err
 }
 
+func (s *UserStorage) GetMatchCount(id uint32) (int, error) {
+	var count int
+	err := s.Transaction(func(txn *UsersTransaction) error {
+		c, err := txn.GetMatchCount(id)
+		count = c
+		return err
+	}, false)
+	return count, err
+}
+
 func (s *UserStorage) Transaction(fn func(txn *UsersTransaction) error, update bool) error {
+	sizes := &pendingSizes{}
 	cb := func(txn *badger.Txn) error {
+		sizes.reset()
 		userTxn := &UsersTransaction{
-			s:   s,
-			txn: txn,
+			s:     s,
+			txn:   txn,
+			sizes: sizes,
 		}
 		if err := fn(userTxn); err != nil {
 			return err
@@ -77,7 +110,11 @@ func (s *UserStorage) Transaction(fn func(txn *UsersTransaction) error, update b
 		return nil
 	}
 	if update {
-		return s.DB.Update(cb)
+		if err := updateWithRetry(s.DB, cb); err != nil {
+			return err
+		}
+		sizes.observe()
+		return nil
 	} else {
 		return s.DB.View(cb)
 	}
@@ -91,27 +128,104 @@ func (s *UserStorage) oldestBucketNum() uint32 {
 type UsersTransaction struct {
 	s   *UserStorage
 	txn *badger.Txn
+
+	// Не обновлять статистику, например при переиндексации статистики за все время
+	skipStats bool
+	// Размеры записанных значений, которые учитываются после коммита
+	sizes *pendingSizes
 }
 
+// Добавляет матч в бакет пользователя с сохранением сортировки по id. Если матч уже есть в бакете, то обновляется только его состояние.
 func (t *UsersTransaction) AddMatch(userid uint32, matchid uint64, state byte) error {
 	value := serializeMatch(matchid, state)
-	bucket := serializeUint32(getBucketNumberFromId(matchid))
-	userBytes := serializeUint32(userid)
-	err := appendValueIfNotExistsAndFilter(t.txn, userBytes, bucket, t.filterOldBuckets, t.s.bucketsDescriptor)
+	bucketNum := getBucketNumberFromId(matchid)
+	stored, previous, err := insertSortedValue(t.txn, userMatchesKey(userid, bucketNum), value, 8, nil, t.s.userMatchesDescriptor, t.sizes)
+	if err != nil {
+		return err
+	}
+	if err = t.setBucketCount(userid, bucketNum, len(stored)/matchSize); err != nil {
+		return err
+	}
+	oldState := noState
+	if previous != nil {
+		oldState = int(previous[8])
+	}
+	return t.updateStats(userid, bucketNum, matchid, oldState, int(state))
+}
+
+// Убирает матч из бакета пользователя. Если бакет опустел, то он удаляется и из индекса бакетов.
+func (t *UsersTransaction) RemoveMatch(userid uint32, matchid uint64) error {
+	bucketNum := getBucketNumberFromId(matchid)
+	stored, removed, err := removeValue(t.txn, userMatchesKey(userid, bucketNum), serializeUint64(matchid), true, t.s.userMatchesDescriptor, t.sizes)
 	if err != nil {
 		return err
 	}
-	key := make([]byte, 8)
-	copy(key, userBytes)
-	copy(key[4:], bucket)
-	return appendValue(t.txn, key, value, t.s.userMatchesDescriptor)
+	if removed == nil && len(stored) > 0 {
+		return nil
+	}
+	if removed != nil {
+		if err = t.updateStats(userid, bucketNum, matchid, int(removed[8]), noState); err != nil {
+			return err
+		}
+	}
+	return t.setBucketCount(userid, bucketNum, len(stored)/matchSize)
+}
+
+// Записывает в индекс бакетов пользователя количество матчей в бакете. Бакет с нулем матчей убирается из индекса.
+func (t *UsersTransaction) setBucketCount(userid uint32, bucket uint32, count int) error {
+	key := userBucketsKey(userid)
+	if count == 0 {
+		_, _, err := removeValue(t.txn, key, serializeUint32(bucket), false, t.s.bucketsDescriptor, t.sizes)
+		return err
+	}
+	_, _, err := insertSortedValue(t.txn, key, serializeBucketIndex(bucket, count), bucketLength, t.s.filterOldBuckets, t.s.bucketsDescriptor, t.sizes)
+	return err
+}
+
+func serializeBucketIndex(bucket uint32, count int) []byte {
+	b := make([]byte, bucketIndexSize)
+	byteOrder.PutUint32(b, bucket)
+	byteOrder.PutUint32(b[bucketLength:], uint32(count))
+	return b
+}
+
+func bucketIndexCount(entry []byte) int {
+	return int(byteOrder.Uint32(entry[bucketLength:]))
+}
+
+// Возвращает количество матчей в бакете по записи индекса, не читая сам бакет.
+//
+// Ключ бакета истекает через TTL после последней записи в него, а из индекса бакет пропадает
+// только когда целиком станет старше TTL. Поэтому самый старый бакет мог уже истечь, пока запись
+// о нем еще в индексе, и для него проверяется, что ключ существует. Более новые бакеты
+// записывались меньше TTL назад и истечь не могли.
+func (t *UsersTransaction) bucketCount(userid uint32, entry []byte, oldestBucketNum uint32) (int, error) {
+	bucket := byteOrder.Uint32(entry)
+	if bucket < oldestBucketNum {
+		return 0, nil
+	}
+	if bucket == oldestBucketNum {
+		_, err := t.txn.Get(userMatchesKey(userid, bucket))
+		if err == badger.ErrKeyNotFound {
+			return 0, nil
+		} else if err != nil {
+			return 0, err
+		}
+	}
+	return bucketIndexCount(entry), nil
+}
+
+// Индекс версии 1 не хранил количество матчей, его нельзя восстановить без чтения бакетов.
+// Такие индексы переводятся в версию 2 миграцией базы при запуске.
+func migrateBucketIndex(_ []byte, version byte) ([]byte, error) {
+	return nil, fmt.Errorf("bucket index version %d must be migrated on startup", version)
 }
 
-func (t *UsersTransaction) filterOldBuckets(buckets []byte) []byte {
-	minBucketNumber := t.s.oldestBucketNum()
-	size := t.s.bucketsDescriptor.size
+func (s *UserStorage) filterOldBuckets(buckets []byte) []byte {
+	minBucketNumber := s.oldestBucketNum()
+	size := s.bucketsDescriptor.size
 	for i := 0; i < len(buckets)/size; i++ {
-		num := deserializeUint32(buckets[i*size : (i+1)*size])
+		num := byteOrder.Uint32(buckets[i*size:])
 		if num >= minBucketNumber {
 			return buckets[i*size:]
 		}
@@ -119,33 +233,52 @@ func (t *UsersTransaction) filterOldBuckets(buckets []byte) []byte {
 	return buckets[:0]
 }
 
-func (t *UsersTransaction) GetLastUserMatches(userid uint32, offset, count int) ([]*types.UserMatch, error) {
-	key := serializeUint32(userid)
+func (t *UsersTransaction) GetLastUserMatches(userid uint32, offset, count int, r MatchFilter) ([]*types.UserMatch, error) {
 	var matches []*types.UserMatch
-	buckets, err := t.getBuckets(key)
+	buckets, err := t.getBuckets(userBucketsKey(userid))
 	if err != nil {
 		return nil, err
 	}
 	oldestBucketNum := t.s.oldestBucketNum()
+	firstBucketNum := oldestBucketNum
+	fromBucket, toBucket := r.buckets()
+	if fromBucket > firstBucketNum {
+		firstBucketNum = fromBucket
+	}
 	offsetBytes := offset * matchSize
 	remainingBytes := count * matchSize
-	k := make([]byte, keyLength+bucketLength)
-	copy(k, key)
+	k := userMatchesKey(userid, 0)
 	// search in reverse order
 	for i := len(buckets) - 1; i >= 0; i-- {
 		currentBucket := byteOrder.Uint32(buckets[i])
-		if currentBucket < oldestBucketNum {
+		if currentBucket > toBucket {
+			continue
+		}
+		if currentBucket < firstBucketNum {
 			break
 		}
 
-		copy(k[keyLength:], buckets[i])
-		value, version, err := getWithValue(t.txn, k)
+		// Бакеты, которые целиком попадают в offset, пропускаем по количеству из индекса
+		if offsetBytes > 0 && r.coversBucket(currentBucket) {
+			n, err := t.bucketCount(userid, buckets[i], oldestBucketNum)
+			if err != nil {
+				return nil, err
+			}
+			if size := n * matchSize; size <= offsetBytes {
+				offsetBytes -= size
+				continue
+			}
+		}
+
+		copy(k[prefixLength+keyLength:], buckets[i][:bucketLength])
+		value, err := t.s.userMatchesDescriptor.get(t.txn, k)
 		if err != nil {
 			if err == badger.ErrKeyNotFound {
 				continue
 			}
 			return nil, err
 		}
+		value = r.trim(value)
 
 		// Пропускаем все матчи без их считывания
 		if offsetBytes > 0 {
@@ -164,11 +297,7 @@ func (t *UsersTransaction) GetLastUserMatches(userid uint32, offset, count int)
 			remainingBytes -= len(value)
 		}
 
-		temp, err := readMatches(version, value)
-		if err != nil {
-			return nil, err
-		}
-		matches = append(temp, matches...)
+		matches = append(parseMatches(value), matches...)
 		if len(matches) >= count {
 			break
 		}
@@ -176,34 +305,40 @@ func (t *UsersTransaction) GetLastUserMatches(userid uint32, offset, count int)
 	return matches, nil
 }
 
-func (t *UsersTransaction) GetUserMatchesAfter(userid uint32, begin uint64, count int) ([]*types.UserMatch, error) {
-	key := serializeUint32(userid)
+func (t *UsersTransaction) GetUserMatchesAfter(userid uint32, begin uint64, count int, r MatchFilter) ([]*types.UserMatch, error) {
 	var matches []*types.UserMatch
-	buckets, err := t.getBuckets(key)
+	buckets, err := t.getBuckets(userBucketsKey(userid))
 	if err != nil {
 		return matches, err
 	}
-	k := make([]byte, keyLength+bucketLength)
-	copy(k, key)
+	k := userMatchesKey(userid, 0)
 	fromBucket := getBucketNumberFromId(begin)
 	oldestBucketNum := t.s.oldestBucketNum()
 	if fromBucket < oldestBucketNum {
 		fromBucket = oldestBucketNum
 	}
+	rangeFrom, toBucket := r.buckets()
+	if fromBucket < rangeFrom {
+		fromBucket = rangeFrom
+	}
 	for i := 0; i < len(buckets); i++ {
 		currentBucket := byteOrder.Uint32(buckets[i])
 		if currentBucket < fromBucket {
 			continue
 		}
+		if currentBucket > toBucket {
+			break
+		}
 
-		copy(k[keyLength:], buckets[i])
-		value, version, err := getWithValue(t.txn, k)
+		copy(k[prefixLength+keyLength:], buckets[i][:bucketLength])
+		value, err := t.s.userMatchesDescriptor.get(t.txn, k)
 		if err != nil {
 			if err == badger.ErrKeyNotFound {
 				continue
 			}
 			return matches, err
 		}
+		value = r.trim(value)
 
 		idxFrom := sort.Search(len(value)/matchSize, func(idx int) bool {
 			id := byteOrder.Uint64(value[idx*matchSize : (idx+1)*matchSize])
@@ -218,12 +353,7 @@ func (t *UsersTransaction) GetUserMatchesAfter(userid uint32, begin uint64, coun
 			continue
 		}
 
-		temp, err := readMatches(version, value[idxFrom*matchSize:idxTo*matchSize])
-		if err != nil {
-			return matches, err
-		}
-
-		matches = append(matches, temp...)
+		matches = append(matches, parseMatches(value[idxFrom*matchSize:idxTo*matchSize])...)
 		if len(matches) >= count {
 			break
 		}
@@ -231,17 +361,22 @@ func (t *UsersTransaction) GetUserMatchesAfter(userid uint32, begin uint64, coun
 	return matches, nil
 }
 
-func (t *UsersTransaction) GetUserMatchesBefore(userid uint32, begin uint64, count int) ([]*types.UserMatch, error) {
-	key := serializeUint32(userid)
+func (t *UsersTransaction) GetUserMatchesBefore(userid uint32, begin uint64, count int, r MatchFilter) ([]*types.UserMatch, error) {
 	var matches []*types.UserMatch
-	buckets, err := t.getBuckets(key)
+	buckets, err := t.getBuckets(userBucketsKey(userid))
 	if err != nil {
 		return matches, err
 	}
-	k := make([]byte, keyLength+bucketLength)
-	copy(k, key)
+	k := userMatchesKey(userid, 0)
 	fromBucket := getBucketNumberFromId(begin)
 	oldestBucketNum := t.s.oldestBucketNum()
+	rangeFrom, toBucket := r.buckets()
+	if fromBucket > toBucket {
+		fromBucket = toBucket
+	}
+	if oldestBucketNum < rangeFrom {
+		oldestBucketNum = rangeFrom
+	}
 
 	// search in reverse order
 	for i := len(buckets) - 1; i >= 0; i-- {
@@ -253,14 +388,15 @@ func (t *UsersTransaction) GetUserMatchesBefore(userid uint32, begin uint64, cou
 			break
 		}
 
-		copy(k[keyLength:], buckets[i])
-		value, version, err := getWithValue(t.txn, k)
+		copy(k[prefixLength+keyLength:], buckets[i][:bucketLength])
+		value, err := t.s.userMatchesDescriptor.get(t.txn, k)
 		if err != nil {
 			if err == badger.ErrKeyNotFound {
 				continue
 			}
 			return matches, err
 		}
+		value = r.trim(value)
 
 		idxTo := sort.Search(len(value)/matchSize, func(idx int) bool {
 			id := byteOrder.Uint64(value[idx*matchSize : (idx+1)*matchSize])
@@ -275,12 +411,7 @@ func (t *UsersTransaction) GetUserMatchesBefore(userid uint32, begin uint64, cou
 			idxFrom = idxTo - (count - len(matches))
 		}
 
-		temp, err := readMatches(version, value[idxFrom*matchSize:idxTo*matchSize])
-		if err != nil {
-			return matches, err
-		}
-
-		matches = append(temp, matches...)
+		matches = append(parseMatches(value[idxFrom*matchSize:idxTo*matchSize]), matches...)
 		if len(matches) >= count {
 			break
 		}
@@ -288,6 +419,24 @@ func (t *UsersTransaction) GetUserMatchesBefore(userid uint32, begin uint64, cou
 	return matches, nil
 }
 
+// Возвращает количество хранящихся матчей пользователя по индексу бакетов, не читая сами бакеты
+func (t *UsersTransaction) GetMatchCount(userid uint32) (int, error) {
+	buckets, err := t.getBuckets(userBucketsKey(userid))
+	if err != nil {
+		return 0, err
+	}
+	oldestBucketNum := t.s.oldestBucketNum()
+	count := 0
+	for _, entry := range buckets {
+		n, err := t.bucketCount(userid, entry, oldestBucketNum)
+		if err != nil {
+			return 0, err
+		}
+		count += n
+	}
+	return count, nil
+}
+
 func (t *UsersTransaction) getBuckets(key []byte) ([][]byte, error) {
 	value, _, err := getWithValue(t.txn, key)
 	if err == badger.ErrKeyNotFound {
@@ -295,23 +444,24 @@ func (t *UsersTransaction) getBuckets(key []byte) ([][]byte, error) {
 	} else if err != nil {
 		return nil, err
 	}
-	index := make([][]byte, len(value)/bucketLength)
+	index := make([][]byte, len(value)/bucketIndexSize)
 	for i := range index {
-		index[i] = value[i*bucketLength : (i+1)*bucketLength]
+		index[i] = value[i*bucketIndexSize : (i+1)*bucketIndexSize]
 	}
 	return index, nil
 }
 
 func (t *UsersTransaction) getMatches(bucket []byte) ([]*types.UserMatch, error) {
-	value, version, err := getWithValue(t.txn, bucket)
+	value, err := t.s.userMatchesDescriptor.get(t.txn, bucket)
 	if err == badger.ErrKeyNotFound {
 		return nil, nil
 	} else if err != nil {
 		return nil, err
 	}
-	return readMatches(version, value)
+	return parseMatches(value), nil
 }
 
+// Переводит значение бакета старой версии в развернутый вид
 func migrateMatches(old []byte, version byte) ([]byte, error) {
 	matches, err := readMatches(version, old)
 	if err != nil {
@@ -3,10 +3,13 @@ package storage
 import (
 	"bytes"
 	"log"
+	"math/rand"
 	"os"
+	"sort"
 	"time"
 
 	"github.com/dgraph-io/badger/v4"
+	"github.com/prometheus/client_golang/prometheus"
 )
 
 func OpenDatabase(path string) (*badger.DB, error) {
@@ -18,14 +21,65 @@ func OpenDatabase(path string) (*badger.DB, error) {
 		return nil, err
 	}
 	runBadgerGc(db, 0.5)
+	registerDatabaseMetrics(db)
 	return db, nil
 }
 
+// Описание значения, которое хранится списком кусков фиксированной длины size.
+//
+// Если заданы encode и decode, то в базе значение хранится в сжатом виде, а в памяти
+// с ним работают в развернутом. migrator переводит значение старой версии сразу в развернутый вид.
 type valueDescriptor struct {
 	version  byte
 	size     int
 	ttl      time.Duration
 	migrator func(old []byte, version byte) ([]byte, error)
+	encode   func(value []byte) []byte
+	decode   func(stored []byte) ([]byte, error)
+	// Если задана, то в нее пишутся размеры записываемых значений
+	sizes prometheus.Observer
+}
+
+// Разворачивает сохраненное значение. Возвращает true, если значение старой версии и его нужно перезаписать.
+func (c *valueDescriptor) read(stored []byte, version byte) ([]byte, bool, error) {
+	if version != c.version {
+		value, err := c.migrator(stored, version)
+		return value, true, err
+	}
+	if c.decode != nil {
+		value, err := c.decode(stored)
+		return value, false, err
+	}
+	return stored, false, nil
+}
+
+// Читает и разворачивает значение по ключу
+func (c *valueDescriptor) get(txn *badger.Txn, key []byte) ([]byte, error) {
+	stored, version, err := getWithValue(txn, key)
+	if err != nil {
+		return nil, err
+	}
+	value, _, err := c.read(stored, version)
+	return value, err
+}
+
+// Создает запись с версией из дескриптора. Нулевой ttl означает, что значение хранится бессрочно.
+func (c *valueDescriptor) entry(key, value []byte) *badger.Entry {
+	if c.encode != nil {
+		value = c.encode(value)
+	}
+	e := badger.NewEntry(key, value).WithMeta(c.version)
+	if c.ttl > 0 {
+		e = e.WithTTL(c.ttl)
+	}
+	return e
+}
+
+// Записывает значение в транзакцию. Размер записи добавляется в sizes, если дескриптор их учитывает.
+func (c *valueDescriptor) set(txn *badger.Txn, key, value []byte, sizes *pendingSizes) error {
+	e := c.entry(key, value)
+	sizes.add(c.sizes, len(e.Value))
+	return txn.SetEntry(e)
 }
 
 // Получает текущее значение по ключу key и добавляет в его конец appendix.
@@ -34,139 +88,160 @@ type valueDescriptor struct {
 //
 // Если сохраненная версия не соответствует текущей, то будет вызван метод миграции из дескриптора,
 // а только затем добавлено и записано новое значение.
-func appendValue(txn *badger.Txn, key, appendix []byte, config *valueDescriptor) error {
+func appendValue(txn *badger.Txn, key, appendix []byte, config *valueDescriptor, sizes *pendingSizes) error {
 	stored, version, err := getWithValue(txn, key)
 
 	if err == badger.ErrKeyNotFound {
-		return txn.SetEntry(
-			badger.NewEntry(key, appendix).
-				WithMeta(config.version).
-				WithTTL(config.ttl),
-		)
+		return config.set(txn, key, appendix, sizes)
 	} else if err != nil {
 		return err
 	}
 
-	if version != config.version {
-		fixed, err := config.migrator(stored, version)
-		if err != nil {
-			return err
-		}
-		stored = fixed
+	if stored, _, err = config.read(stored, version); err != nil {
+		return err
 	}
 
 	newValue := make([]byte, len(stored)+len(appendix))
 	copy(newValue, stored)
 	copy(newValue[len(stored):], appendix)
-	return txn.SetEntry(
-		badger.NewEntry(key, newValue).
-			WithMeta(config.version).
-			WithTTL(config.ttl),
-	)
+	return config.set(txn, key, newValue, sizes)
 }
 
-// Метод аналогичен appendValue, за исключением того что сохраненные данные воспринимаются
-// в качестве Set и в них не могут содержаться одинаковые значения.
+// Метод аналогичен appendValue, но сохраненное значение воспринимается как отсортированный
+// по первым idSize байтам список кусков фиксированной длины. appendix вставляется на свое место в списке,
+// а если кусок с такими же первыми idSize байтами уже есть, то он заменяется на appendix.
 //
-// На одинаковость значения проверяются через сравнение кусков байт фиксированной длины из дескриптора.
-func appendValueIfNotExistsAndFilter(txn *badger.Txn, key, appendix []byte, filter func([]byte) []byte, config *valueDescriptor) error {
+// Если значение изменилось и передан filter, то перед записью значение пропускается через него.
+//
+// Возвращает новое значение и замененный кусок или nil, если appendix был добавлен.
+func insertSortedValue(txn *badger.Txn, key, appendix []byte, idSize int, filter func([]byte) []byte, config *valueDescriptor, sizes *pendingSizes) ([]byte, []byte, error) {
 	stored, version, err := getWithValue(txn, key)
 
 	if err == badger.ErrKeyNotFound {
-		return txn.SetEntry(
-			badger.NewEntry(key, appendix).
-				WithMeta(config.version).
-				WithTTL(config.ttl),
-		)
+		return appendix, nil, config.set(txn, key, appendix, sizes)
 	} else if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	updated := false
-	if version != config.version {
-		fixed, err := config.migrator(stored, version)
-		stored = fixed
-		if err != nil {
-			return err
-		}
-		updated = true
-	}
-
-	exists := false
-	size := config.size
-	for i := len(stored)/size - 1; i >= 0; i-- {
-		if bytes.Equal(stored[i*size:(i+1)*size], appendix) {
-			exists = true
-			break
-		}
+	stored, updated, err := config.read(stored, version)
+	if err != nil {
+		return nil, nil, err
 	}
 
-	if !exists {
+	stored, previous, changed := insertSorted(stored, appendix, idSize, config.size)
+	if changed {
 		updated = true
-		newValue := make([]byte, len(stored)+len(appendix))
-		copy(newValue, stored)
-		copy(newValue[len(stored):], appendix)
-		stored = newValue
-
 		if filter != nil {
 			stored = filter(stored)
 			if len(stored) == 0 {
-				return txn.Delete(key)
+				return stored, previous, txn.Delete(key)
 			}
 		}
 	}
 
 	if updated {
-		return txn.SetEntry(
-			badger.NewEntry(key, stored).
-				WithMeta(config.version).
-				WithTTL(config.ttl),
-		)
+		return stored, previous, config.set(txn, key, stored, sizes)
 	}
-	return nil
+	return stored, previous, nil
 }
 
-func removeValue(txn *badger.Txn, key, value []byte, multiple bool, config *valueDescriptor) error {
+// Вставляет appendix в отсортированный список кусков размера size или заменяет кусок с тем же id.
+// Возвращает новый список, копию замененного куска или nil и признак того, что список изменился.
+func insertSorted(stored, appendix []byte, idSize, size int) ([]byte, []byte, bool) {
+	count := len(stored) / size
+	id := appendix[:idSize]
+	// Обычно новое значение самое свежее, поэтому сначала проверяем конец
+	idx := count
+	if count > 0 && bytes.Compare(stored[(count-1)*size:(count-1)*size+idSize], id) >= 0 {
+		idx = sort.Search(count, func(i int) bool {
+			return bytes.Compare(stored[i*size:i*size+idSize], id) >= 0
+		})
+	}
+
+	if idx < count && bytes.Equal(stored[idx*size:idx*size+idSize], id) {
+		chunk := stored[idx*size : (idx+1)*size]
+		previous := append([]byte(nil), chunk...)
+		if bytes.Equal(chunk, appendix) {
+			return stored, previous, false
+		}
+		copy(chunk, appendix)
+		return stored, previous, true
+	}
+
+	newValue := make([]byte, len(stored)+len(appendix))
+	copy(newValue, stored[:idx*size])
+	copy(newValue[idx*size:], appendix)
+	copy(newValue[idx*size+len(appendix):], stored[idx*size:])
+	return newValue, nil, true
+}
+
+// Удаляет из значения по ключу key куски фиксированной длины, которые начинаются с value.
+// Если multiple равен false, то удаляется только последнее совпадение.
+//
+// Возвращает оставшееся значение и последний удаленный кусок или nil, если ничего не удалено.
+// Пустое значение удаляется вместе с ключом.
+func removeValue(txn *badger.Txn, key, value []byte, multiple bool, config *valueDescriptor, sizes *pendingSizes) ([]byte, []byte, error) {
 	stored, version, err := getWithValue(txn, key)
 	if err == badger.ErrKeyNotFound {
-		return nil
+		return nil, nil, nil
 	} else if err != nil {
-		return err
+		return nil, nil, err
 	}
 
-	updated := false
-	if version != config.version {
-		fixed, err := config.migrator(stored, version)
-		stored = fixed
-		if err != nil {
-			return err
-		}
+	stored, updated, err := config.read(stored, version)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	stored, removed := removeChunks(stored, value, multiple, config.size)
+	if removed != nil {
 		updated = true
 	}
+	if len(stored) == 0 {
+		return stored, removed, txn.Delete(key)
+	}
+	if updated {
+		return stored, removed, config.set(txn, key, stored, sizes)
+	}
+	return stored, nil, nil
+}
 
-	size := config.size
+// Удаляет из списка кусков размера size те, что начинаются с prefix.
+// Если multiple равен false, то удаляется только последнее совпадение.
+//
+// Возвращает новый список и копию последнего удаленного куска или nil.
+func removeChunks(stored, prefix []byte, multiple bool, size int) ([]byte, []byte) {
+	var removed []byte
 	for i := len(stored)/size - 1; i >= 0; i-- {
-		if bytes.Equal(stored[i*size:(i+1)*size], value) {
+		if bytes.HasPrefix(stored[i*size:(i+1)*size], prefix) {
+			removed = append(removed[:0], stored[i*size:(i+1)*size]...)
 			stored = append(stored[:i*size], stored[(i+1)*size:]...)
-			updated = true
-			if multiple {
-				continue
-			} else {
+			if !multiple {
 				break
 			}
 		}
 	}
-	if len(stored) == 0 {
-		return txn.Delete(key)
-	}
-	if updated {
-		return txn.SetEntry(
-			badger.NewEntry(key, stored).
-				WithMeta(config.version).
-				WithTTL(config.ttl),
-		)
+	return stored, removed
+}
+
+const maxConflictRetries = 10
+
+// Аналог DB.Update, который повторяет транзакцию, если она завершилась с badger.ErrConflict.
+func updateWithRetry(db *badger.DB, fn func(txn *badger.Txn) error) error {
+	var err error
+	for attempt := 1; attempt <= maxConflictRetries; attempt++ {
+		if attempt > 1 {
+			txnRetries.Inc()
+		}
+		err = db.Update(fn)
+		if err != badger.ErrConflict {
+			return err
+		}
+		txnConflicts.Inc()
+		time.Sleep(time.Duration(rand.Intn(attempt*5)+1) * time.Millisecond)
 	}
-	return nil
+	txnConflictFailures.Inc()
+	return err
 }
 
 func getWithValue(txn *badger.Txn, key []byte) (value []byte, version byte, err error) {
@@ -204,11 +279,13 @@ func (l *logWrapper) Debugf(f string, v ...interface{}) {
 func runBadgerGc(db *badger.DB, discardRatio float64) {
 	go func() {
 		for range time.Tick(5 * time.Minute) {
+			gcRuns.Inc()
 			for {
 				err := db.RunValueLogGC(discardRatio)
 				if err != nil {
 					break
 				}
+				gcRewrites.Inc()
 			}
 		}
 	}()
@@ -0,0 +1,325 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/VimeWorld/matches-db/types"
+	"github.com/dgraph-io/badger/v4"
+)
+
+const verifyMaxSamples = 100
+
+type VerifyReport struct {
+	Buckets int64 `json:"buckets"`
+	Entries int64 `json:"entries"`
+
+	// Матчи, тело которых удалено или истекло
+	MissingMatches int64 `json:"missing_matches"`
+	// Матчи, которые лежат не в том бакете
+	WrongBucket int64 `json:"wrong_bucket"`
+	// Бакеты, матчи в которых не отсортированы
+	Unsorted int64 `json:"unsorted"`
+	// Повторяющиеся матчи в бакетах
+	Duplicates int64 `json:"duplicates"`
+	// Записи в индексах бакетов, для которых нет ключа бакета
+	MissingBuckets int64 `json:"missing_buckets"`
+	// Бакеты, длина которых не кратна размеру записи или которые не удалось разобрать
+	BadLength int64 `json:"bad_length"`
+	// Записи в индексах бакетов с неверным количеством матчей
+	WrongCounts int64 `json:"wrong_counts"`
+
+	// Количество исправленных ключей в режиме fix
+	Fixed   int64    `json:"fixed"`
+	Samples []string `json:"samples,omitempty"`
+}
+
+func (r *VerifyReport) sample(format string, args ...any) {
+	if len(r.Samples) < verifyMaxSamples {
+		r.Samples = append(r.Samples, fmt.Sprintf(format, args...))
+	}
+}
+
+// Проверяет индексы пользователей на соответствие сохраненным матчам.
+// Если fix равен true, то найденные ошибки исправляются, но только пока не включен режим обслуживания.
+//
+// progress вызывается с количеством проверенных ключей.
+func (s *UserStorage) Verify(ctx context.Context, fix bool, progress func(processed int64)) (*VerifyReport, error) {
+	report := &VerifyReport{}
+	if fix && s.Writes.Locked() {
+		return report, ErrWriteLocked
+	}
+	var processed int64
+
+	var broken [][]byte
+	err := s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{keyPrefixUserMatches}, PrefetchValues: true, PrefetchSize: 100})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := it.Item()
+			key := item.KeyCopy(nil)
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			ok, err := s.verifyBucket(txn, key, value, item.UserMeta(), report)
+			if err != nil {
+				return err
+			}
+			if !ok {
+				broken = append(broken, key)
+			}
+			processed++
+			if progress != nil && processed%10000 == 0 {
+				progress(processed)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return report, err
+	}
+
+	var brokenIndexes [][]byte
+	err = s.DB.View(func(txn *badger.Txn) error {
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{keyPrefixUserBuckets}, PrefetchValues: true, PrefetchSize: 100})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			item := it.Item()
+			key := item.KeyCopy(nil)
+			value, err := item.ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			userid := byteOrder.Uint32(key[prefixLength:])
+			ok := true
+			for i := 0; i+bucketIndexSize <= len(value); i += bucketIndexSize {
+				bucket := byteOrder.Uint32(value[i:])
+				matches, err := s.userMatchesDescriptor.get(txn, userMatchesKey(userid, bucket))
+				if err == badger.ErrKeyNotFound {
+					report.MissingBuckets++
+					report.sample("user %d: bucket %d is in the index but has no matches", userid, bucket)
+					ok = false
+				} else if err != nil {
+					return err
+				} else if count := bucketIndexCount(value[i:]); count != len(matches)/matchSize {
+					report.WrongCounts++
+					report.sample("user %d: bucket %d has %d matches but the index says %d", userid, bucket, len(matches)/matchSize, count)
+					ok = false
+				}
+			}
+			if !ok {
+				brokenIndexes = append(brokenIndexes, key)
+			}
+			processed++
+			if progress != nil && processed%10000 == 0 {
+				progress(processed)
+			}
+		}
+		return nil
+	})
+	if progress != nil {
+		progress(processed)
+	}
+	if err != nil || !fix {
+		return report, err
+	}
+
+	for _, key := range broken {
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+		err = s.Writes.Run(func() error {
+			return s.Transaction(func(txn *UsersTransaction) error {
+				return txn.fixBucket(key)
+			}, true)
+		})
+		if err != nil {
+			return report, err
+		}
+		report.Fixed++
+	}
+	for _, key := range brokenIndexes {
+		if err = ctx.Err(); err != nil {
+			return report, err
+		}
+		err = s.Writes.Run(func() error {
+			return s.Transaction(func(txn *UsersTransaction) error {
+				return txn.fixBucketIndex(key)
+			}, true)
+		})
+		if err != nil {
+			return report, err
+		}
+		report.Fixed++
+	}
+	return report, nil
+}
+
+func (s *UserStorage) verifyBucket(txn *badger.Txn, key, stored []byte, version byte, report *VerifyReport) (bool, error) {
+	userid := byteOrder.Uint32(key[prefixLength:])
+	bucket := byteOrder.Uint32(key[prefixLength+keyLength:])
+	report.Buckets++
+	ok := true
+
+	value, _, err := s.userMatchesDescriptor.read(stored, version)
+	if err != nil {
+		report.BadLength++
+		report.sample("user %d: bucket %d can not be decoded: %s", userid, bucket, err)
+		return false, nil
+	}
+
+	if len(value)%matchSize != 0 {
+		report.BadLength++
+		report.sample("user %d: bucket %d has length %d", userid, bucket, len(value))
+		value = value[:len(value)-len(value)%matchSize]
+		ok = false
+	}
+
+	var prev uint64
+	sorted := true
+	for i := 0; i < len(value); i += matchSize {
+		id := byteOrder.Uint64(value[i:])
+		report.Entries++
+		if i > 0 {
+			if id == prev {
+				report.Duplicates++
+				report.sample("user %d: match %d is duplicated", userid, id)
+				ok = false
+			} else if id < prev {
+				sorted = false
+			}
+		}
+		prev = id
+
+		if num := getBucketNumberFromId(id); num != bucket {
+			report.WrongBucket++
+			report.sample("user %d: match %d is in bucket %d instead of %d", userid, id, bucket, num)
+			ok = false
+		}
+		_, err := txn.Get(matchKey(id))
+		if err == badger.ErrKeyNotFound {
+			report.MissingMatches++
+			report.sample("user %d: match %d does not exist", userid, id)
+			ok = false
+		} else if err != nil {
+			return false, err
+		}
+	}
+	if !sorted {
+		report.Unsorted++
+		report.sample("user %d: bucket %d is not sorted", userid, bucket)
+		ok = false
+	}
+	return ok, nil
+}
+
+// Обрезает неполную запись в конце бакета, убирает из него несуществующие матчи и дубликаты,
+// переносит матчи из чужого бакета в правильный и сортирует оставшиеся.
+func (t *UsersTransaction) fixBucket(key []byte) error {
+	item, err := t.txn.Get(key)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	stored, err := item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	// Значение, которое не удалось разобрать, удаляется целиком
+	value, _, err := t.s.userMatchesDescriptor.read(stored, item.UserMeta())
+	if err != nil {
+		value = nil
+	}
+	userid := byteOrder.Uint32(key[prefixLength:])
+	bucket := byteOrder.Uint32(key[prefixLength+keyLength:])
+
+	value = value[:len(value)-len(value)%matchSize]
+	fixed := make([]byte, 0, len(value))
+	var dropped, moved [][]byte
+	for i := 0; i < len(value); i += matchSize {
+		entry := value[i : i+matchSize]
+		id := byteOrder.Uint64(entry)
+		_, err := t.txn.Get(matchKey(id))
+		if err == badger.ErrKeyNotFound {
+			// Матч с истекшим телом остается в статистике за все время
+			if !t.s.AllTimeStats || !t.s.isExpired(id) {
+				dropped = append(dropped, entry)
+			}
+			continue
+		} else if err != nil {
+			return err
+		}
+		if getBucketNumberFromId(id) != bucket {
+			dropped = append(dropped, entry)
+			moved = append(moved, entry)
+			continue
+		}
+		fixed = append(fixed, entry...)
+	}
+	fixed = sortChunks(fixed, 8, matchSize)
+
+	if len(fixed) == 0 {
+		if err = t.txn.Delete(key); err != nil {
+			return err
+		}
+	} else {
+		e := t.s.userMatchesDescriptor.entry(key, fixed)
+		e.ExpiresAt = item.ExpiresAt()
+		t.sizes.add(t.s.userMatchesDescriptor.sizes, len(e.Value))
+		if err = t.txn.SetEntry(e); err != nil {
+			return err
+		}
+	}
+	if err = t.setBucketCount(userid, bucket, len(fixed)/matchSize); err != nil {
+		return err
+	}
+
+	for _, entry := range dropped {
+		if err = t.updateStats(userid, bucket, byteOrder.Uint64(entry), int(entry[8]), noState); err != nil {
+			return err
+		}
+	}
+	for _, entry := range moved {
+		if err = t.AddMatch(userid, byteOrder.Uint64(entry), entry[8]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Тело матча уже могло истечь по TTL. Тела хранятся дольше бакетов, поэтому если матч
+// новее TTL бакетов, то его тело пропало по другой причине.
+func (s *UserStorage) isExpired(id uint64) bool {
+	return time.UnixMilli(int64(types.GetSnowflakeTs(id))).Before(time.Now().Add(-s.TTL))
+}
+
+// Убирает из индекса бакетов пользователя бакеты, для которых нет ключа, и исправляет количество матчей.
+func (t *UsersTransaction) fixBucketIndex(key []byte) error {
+	value, _, err := getWithValue(t.txn, key)
+	if err == badger.ErrKeyNotFound {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	userid := byteOrder.Uint32(key[prefixLength:])
+	for i := 0; i+bucketIndexSize <= len(value); i += bucketIndexSize {
+		bucket := byteOrder.Uint32(value[i:])
+		matches, err := t.s.userMatchesDescriptor.get(t.txn, userMatchesKey(userid, bucket))
+		if err != nil && err != badger.ErrKeyNotFound {
+			return err
+		}
+		if err = t.setBucketCount(userid, bucket, len(matches)/matchSize); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,296 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math"
+	"math/rand"
+
+	"github.com/dgraph-io/badger/v4"
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	dictionaryKeyPrefix = "zstd-dict-"
+	// Ограничение на размер истории словаря, больше zstd все равно не использует эффективно
+	dictionaryMaxHistory = 112 << 10
+	// BuildDict сжимает каждый образец одним блоком, а блок zstd не больше 128КБ
+	dictionaryBlockSize = 128 << 10
+	// Минимальное количество тел матчей для обучения словаря
+	dictionaryMinSamples = 8
+)
+
+var errNoDictionary = errors.New("zstd dictionary for the match is not loaded")
+
+// Кодек zstd со всеми сохраненными словарями. Сжатие всегда идет последним словарем,
+// а распаковка выбирает словарь по id из заголовка фрейма.
+type zstdCodec struct {
+	id      uint32
+	encoder *zstd.Encoder
+	decoder *zstd.Decoder
+}
+
+func dictionaryKey(id uint32) []byte {
+	key := metaKey(dictionaryKeyPrefix)
+	key = append(key, 0, 0, 0, 0)
+	byteOrder.PutUint32(key[len(key)-4:], id)
+	return key
+}
+
+func (s *MatchesStorage) loadDictionaries() error {
+	var dicts [][]byte
+	var last uint32
+	err := s.DB.View(func(txn *badger.Txn) error {
+		prefix := metaKey(dictionaryKeyPrefix)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: prefix, PrefetchValues: true})
+		defer it.Close()
+		for it.Rewind(); it.Valid(); it.Next() {
+			dict, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			dicts = append(dicts, dict)
+			last = byteOrder.Uint32(it.Item().Key()[len(prefix):])
+		}
+		return nil
+	})
+	if err != nil || len(dicts) == 0 {
+		return err
+	}
+
+	decoder, err := zstd.NewReader(nil, zstd.WithDecoderDicts(dicts...), zstd.WithDecoderConcurrency(0))
+	if err != nil {
+		return err
+	}
+	// Ключи отсортированы по id, последний словарь - самый новый
+	encoder, err := zstd.NewWriter(nil, zstd.WithEncoderDict(dicts[len(dicts)-1]))
+	if err != nil {
+		return err
+	}
+	s.zstd.Store(&zstdCodec{id: last, encoder: encoder, decoder: decoder})
+	return nil
+}
+
+// Обучает новый словарь zstd на samples случайных телах матчей и начинает сжимать им новые матчи.
+// Старые словари остаются в базе, чтобы сжатые ими матчи читались.
+//
+// Возвращает id нового словаря.
+func (s *MatchesStorage) TrainDictionary(samples int) (uint32, error) {
+	contents, err := s.sampleMatches(samples)
+	if err != nil {
+		return 0, err
+	}
+	if len(contents) < dictionaryMinSamples {
+		return 0, errors.New("not enough matches to train a dictionary")
+	}
+
+	// В историю попадает начало каждого матча, чтобы словарь не подстраивался под один большой матч
+	history := make([]byte, 0, dictionaryMaxHistory)
+	share := dictionaryMaxHistory / len(contents)
+	for _, data := range contents {
+		if len(data) > share {
+			data = data[:share]
+		}
+		history = append(history, data...)
+	}
+
+	var blocks [][]byte
+	for _, data := range contents {
+		for len(data) > dictionaryBlockSize {
+			blocks = append(blocks, data[:dictionaryBlockSize])
+			data = data[dictionaryBlockSize:]
+		}
+		blocks = append(blocks, data)
+	}
+
+	var id uint32 = 1
+	if codec := s.zstd.Load(); codec != nil {
+		id = codec.id + 1
+	}
+	dict, err := buildDict(zstd.BuildDictOptions{
+		ID:       id,
+		Contents: blocks,
+		History:  history,
+		Offsets:  [3]int{1, 4, 8},
+		Level:    zstd.SpeedDefault,
+	})
+	if err != nil {
+		return 0, err
+	}
+
+	err = s.Writes.Run(func() error {
+		return s.DB.Update(func(txn *badger.Txn) error {
+			return txn.Set(dictionaryKey(id), dict)
+		})
+	})
+	if err != nil {
+		return 0, err
+	}
+	return id, s.loadDictionaries()
+}
+
+// BuildDict паникует с делением на ноль, если в образцах меньше 512 повторов, например когда их слишком мало
+func buildDict(opts zstd.BuildDictOptions) (dict []byte, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("could not build dictionary, too little data: %v", r)
+		}
+	}()
+	return zstd.BuildDict(opts)
+}
+
+// Читает до count тел матчей со случайными id между самым старым и самым новым матчем
+func (s *MatchesStorage) sampleMatches(count int) ([][]byte, error) {
+	var contents [][]byte
+	err := s.DB.View(func(txn *badger.Txn) error {
+		first, last, ok := matchIdRange(txn)
+		if !ok {
+			return nil
+		}
+		seen := make(map[uint64]bool, count)
+		it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{keyPrefixMatch}})
+		defer it.Close()
+		for i := 0; i < count; i++ {
+			// Матчи распределены по времени неравномерно, поэтому уже прочитанные пропускаются
+			var id uint64
+			for it.Seek(matchKey(first + uint64(rand.Int63n(int64(last-first)+1)))); it.Valid(); it.Next() {
+				if id = byteOrder.Uint64(it.Item().Key()[prefixLength:]); !seen[id] {
+					break
+				}
+			}
+			if !it.Valid() {
+				continue
+			}
+			seen[id] = true
+			data, err := s.getMatch(txn, id)
+			if err != nil {
+				return err
+			}
+			if len(data) > 0 {
+				contents = append(contents, data)
+			}
+		}
+		return nil
+	})
+	return contents, err
+}
+
+// Возвращает id самого старого и самого нового матча. ok равен false, если матчей нет.
+func matchIdRange(txn *badger.Txn) (first, last uint64, ok bool) {
+	it := txn.NewIterator(badger.IteratorOptions{Prefix: []byte{keyPrefixMatch}})
+	it.Rewind()
+	if it.Valid() {
+		first, ok = byteOrder.Uint64(it.Item().Key()[prefixLength:]), true
+	}
+	it.Close()
+	if !ok {
+		return 0, 0, false
+	}
+
+	it = txn.NewIterator(badger.IteratorOptions{Prefix: []byte{keyPrefixMatch}, Reverse: true})
+	defer it.Close()
+	last = first
+	if it.Seek(matchKey(math.MaxUint64)); it.Valid() {
+		last = byteOrder.Uint64(it.Item().Key()[prefixLength:])
+	}
+	return first, last, true
+}
+
+// Перезаписывает матчи в текущем формате: переводит сырой deflate в новый формат, а несжатые тела
+// сжимает, если newEntry теперь выбрал бы для них сжатие, и дописывает им хэш. См. needsRecompress.
+// Время жизни матчей не меняется. Если включен режим обслуживания, то останавливается с ErrWriteLocked.
+//
+// progress вызывается после каждой пачки с количеством просмотренных матчей. Возвращает количество перезаписанных матчей.
+func (s *MatchesStorage) Recompress(ctx context.Context, progress func(processed, total int64)) (int64, error) {
+	if s.Writes.Locked() {
+		return 0, ErrWriteLocked
+	}
+	total, err := s.countMatches()
+	if err != nil {
+		return 0, err
+	}
+
+	var processed, recompressed int64
+	cursor := matchKey(0)
+	for {
+		if err = ctx.Err(); err != nil {
+			return recompressed, err
+		}
+
+		ids, err := s.nextMatchIds(cursor, reindexBatchSize)
+		if err != nil {
+			return recompressed, err
+		}
+		if len(ids) == 0 {
+			break
+		}
+
+		var batch int64
+		err = s.Writes.Run(func() error {
+			return updateWithRetry(s.DB, func(txn *badger.Txn) error {
+				batch = 0
+				for _, id := range ids {
+					item, err := txn.Get(matchKey(id))
+					if err == badger.ErrKeyNotFound {
+						continue
+					} else if err != nil {
+						return err
+					}
+					if !s.needsRecompress(item.UserMeta(), int(item.ValueSize())) {
+						continue
+					}
+					var data []byte
+					err = item.Value(func(val []byte) error {
+						data, err = s.decode(item.UserMeta(), val)
+						return err
+					})
+					if err != nil {
+						return err
+					}
+					e, err := s.newEntry(id, data)
+					if err != nil {
+						return err
+					}
+					e.ExpiresAt = item.ExpiresAt()
+					if err = txn.SetEntry(e); err != nil {
+						return err
+					}
+					batch++
+				}
+				return nil
+			})
+		})
+		if err != nil {
+			return recompressed, err
+		}
+		recompressed += batch
+
+		processed += int64(len(ids))
+		if progress != nil {
+			progress(processed, total)
+		}
+		last := ids[len(ids)-1]
+		if last == math.MaxUint64 {
+			break
+		}
+		cursor = matchKey(last + 1)
+	}
+	return recompressed, nil
+}
+
+// Проверяет, нужно ли перезаписать матч с типом meta, значение которого занимает storedSize байт.
+// Перезаписываются только сырой deflate и несжатые тела: без хэша или такие, которые newEntry
+// теперь сжал бы. Тела в zlib и zstd не трогаются.
+func (s *MatchesStorage) needsRecompress(meta byte, storedSize int) bool {
+	switch meta &^ matchesMetaHashed {
+	case matchesMetaTypeFlate:
+		return true
+	case matchesMetaTypeRaw:
+		if meta&matchesMetaHashed == 0 {
+			return true
+		}
+		return s.matchType(storedSize-8, s.zstd.Load()) != matchesMetaTypeRaw
+	}
+	return false
+}
@@ -7,6 +7,12 @@ import (
 
 const SnowflakeEpoch uint64 = 1546300800000
 
+const (
+	StateLoss = byte(0)
+	StateWin  = byte(1)
+	StateDraw = byte(2)
+)
+
 type UserMatch struct {
 	Id    uint64 `json:"id"`
 	State byte   `json:"state"`
@@ -20,6 +26,22 @@ func (s *UserMatch) String() string {
 	return fmt.Sprint("UserMatch{id=", s.Id, ", state=", s.State, "}")
 }
 
+// Матч, в котором участвовали оба пользователя, с состоянием каждого из них
+type CommonMatch struct {
+	Id         uint64 `json:"id"`
+	State      byte   `json:"state"`
+	OtherState byte   `json:"other_state"`
+}
+
+type UserStats struct {
+	Total      int    `json:"total"`
+	Wins       int    `json:"wins"`
+	Losses     int    `json:"losses"`
+	Draws      int    `json:"draws"`
+	FirstMatch uint64 `json:"first_match"`
+	LastMatch  uint64 `json:"last_match"`
+}
+
 func GetSnowflakeTs(id uint64) uint64 {
 	return (id >> 22) + SnowflakeEpoch
 }
@@ -46,3 +68,49 @@ type MatchTeam struct {
 type MatchPlayer struct {
 	Id uint32 `json:"id"`
 }
+
+// Возвращает состояние каждого участника матча: победа, поражение или ничья, если победителей нет.
+func (m *Match) GetStates() map[uint32]byte {
+	winners := m.GetWinners()
+	states := make(map[uint32]byte, len(m.Players))
+	for _, player := range m.Players {
+		state := StateLoss
+		if len(winners) == 0 {
+			state = StateDraw
+		} else {
+			for _, a := range winners {
+				if player.Id == a {
+					state = StateWin
+					break
+				}
+			}
+		}
+		states[player.Id] = state
+	}
+	return states
+}
+
+func (m *Match) GetWinners() []uint32 {
+	var winners []uint32
+	if m.Winner.Player != 0 {
+		winners = []uint32{m.Winner.Player}
+	} else if len(m.Winner.Players) > 0 {
+		winners = m.Winner.Players
+	} else if m.Winner.Team != "" {
+		for _, team := range m.Teams {
+			if team.Id == m.Winner.Team {
+				winners = team.Members
+				break
+			}
+		}
+	} else if len(m.Winner.Teams) > 0 {
+		for _, team := range m.Teams {
+			for _, wTeamId := range m.Winner.Teams {
+				if team.Id == wTeamId {
+					winners = append(winners, team.Members...)
+				}
+			}
+		}
+	}
+	return winners
+}